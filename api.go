@@ -0,0 +1,213 @@
+// api
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Summary of the production in a period (a day or a month).
+*/
+type Summary struct {
+	Period          string
+	Energy          float64
+	PeakPower       float64
+	PeakTime        *time.Time `json:",omitempty"`
+	ProductionHours float64
+	Days            []*Summary `json:",omitempty"`
+}
+
+/* Maximum number of steps returned by /history. */
+const historyMaxBuckets = 10000
+
+/*
+Register the REST endpoints on the history.
+*/
+func (p *Publisher) routeHistory(router *mux.Router) {
+	router.HandleFunc("/history", p.getHistory).Methods("GET")
+	router.HandleFunc("/days/{date}", p.getDay).Methods("GET")
+	router.HandleFunc("/months/{month}", p.getMonth).Methods("GET")
+	router.HandleFunc("/reports/{period}/{key}", p.getReport).Methods("GET")
+}
+
+/*
+Query the history, e.g. /history?from=2026-10-01&to=2026-10-02&step=5m&fields=Power,VoltagePV1
+The values are averages per step, unless value=min or value=max is given.
+Use format=csv for CSV instead of JSON.
+*/
+func (p *Publisher) getHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := time.Now().In(p.history.location)
+
+	from := p.history.bucketStart(now, oneDay)
+	to := now
+	var err error
+	if value := query.Get("from"); value != "" {
+		if from, err = p.parseTime(value); err != nil {
+			http.Error(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = p.parseTime(value); err != nil {
+			http.Error(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	step := 5 * time.Minute
+	if value := query.Get("step"); value != "" {
+		if step, err = parseStep(value); err != nil || step <= 0 || step > oneDay || oneDay%step != 0 {
+			http.Error(w, "Invalid step (a divisor of a day, e.g. 5m, 1h or 1d): "+value, http.StatusBadRequest)
+			return
+		}
+	}
+	if to.Sub(from)/step > historyMaxBuckets {
+		http.Error(w, fmt.Sprintf("Too many steps (at most %d); use a larger step", historyMaxBuckets),
+			http.StatusBadRequest)
+		return
+	}
+
+	aggregates := p.history.Query(from, to, step)
+
+	var fields []string
+	if value := query.Get("fields"); value != "" {
+		fields = strings.Split(value, ",")
+	} else {
+		fields = historyFields(aggregates)
+	}
+
+	values := func(agg *Aggregate) map[string]float64 { return agg.Avg }
+	switch query.Get("value") {
+	case "min":
+		values = func(agg *Aggregate) map[string]float64 { return agg.Min }
+	case "max":
+		values = func(agg *Aggregate) map[string]float64 { return agg.Max }
+	}
+
+	if query.Get("format") == "csv" || r.Header.Get("Accept") == "text/csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		writer := csv.NewWriter(w)
+		_ = writer.Write(append([]string{"Time", "Samples"}, fields...))
+		for _, agg := range aggregates {
+			row := []string{agg.Start.Format(time.RFC3339), strconv.Itoa(agg.Samples)}
+			for _, field := range fields {
+				row = append(row, strconv.FormatFloat(values(agg)[field], 'f', -1, 64))
+			}
+			_ = writer.Write(row)
+		}
+		writer.Flush()
+		return
+	}
+
+	rows := make([]map[string]interface{}, 0, len(aggregates))
+	for _, agg := range aggregates {
+		row := map[string]interface{}{"Time": agg.Start, "Samples": agg.Samples}
+		for _, field := range fields {
+			if value, ok := values(agg)[field]; ok {
+				row[field] = value
+			}
+		}
+		rows = append(rows, row)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rows)
+}
+
+/*
+Summary of a day, e.g. /days/2026-10-19
+*/
+func (p *Publisher) getDay(w http.ResponseWriter, r *http.Request) {
+	start, err := time.ParseInLocation("2006-01-02", mux.Vars(r)["date"], p.history.location)
+	if err != nil {
+		http.Error(w, "Invalid date (yyyy-mm-dd)", http.StatusBadRequest)
+		return
+	}
+	report := p.history.Report("day", start)
+	if report == nil {
+		http.Error(w, "No data for "+dayOf(start), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summaryOf(report))
+}
+
+/*
+Summary of a month including its days, e.g. /months/2026-10
+*/
+func (p *Publisher) getMonth(w http.ResponseWriter, r *http.Request) {
+	start, err := time.ParseInLocation("2006-01", mux.Vars(r)["month"], p.history.location)
+	if err != nil {
+		http.Error(w, "Invalid month (yyyy-mm)", http.StatusBadRequest)
+		return
+	}
+	report := p.history.Report("month", start)
+	if report == nil {
+		http.Error(w, "No data for "+start.Format("2006-01"), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summaryOf(report))
+}
+
+/* The summary of a report, including the summaries of its details. */
+func summaryOf(report *Report) *Summary {
+	summary := &Summary{
+		Period:          report.Key,
+		Energy:          report.Energy,
+		PeakPower:       report.PeakPower,
+		PeakTime:        report.PeakTime,
+		ProductionHours: report.ProductionHours,
+	}
+	for _, detail := range report.Details {
+		summary.Days = append(summary.Days, summaryOf(detail))
+	}
+	return summary
+}
+
+/* Parse a time as RFC3339, as date/time or as date in the local time zone. */
+func (p *Publisher) parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04", value, p.history.location); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, p.history.location)
+}
+
+/* Parse a step as duration (e.g. 5m), also supporting days (e.g. 1d). */
+func parseStep(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		count, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid days: %s", value)
+		}
+		return time.Duration(count) * oneDay, nil
+	}
+	return time.ParseDuration(value)
+}
+
+/* All fields available in the aggregates. */
+func historyFields(aggregates []*Aggregate) []string {
+	known := make(map[string]bool)
+	fields := make([]string, 0)
+	for _, agg := range aggregates {
+		for field := range agg.Avg {
+			if !known[field] {
+				known[field] = true
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,128 @@
+// command
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"growattrr/diag"
+	"growattrr/reader"
+)
+
+/*
+A command to control the reader (e.g. received on MQTT). Commands are
+executed by the publisher in its listen loop; Done is called with the
+result.
+*/
+type Command struct {
+	Name  string                         `json:"command"`
+	Value string                         `json:"value"`
+	Done  func(result string, err error) `json:"-"`
+}
+
+/* Acknowledgement of a command. */
+type CommandResponse struct {
+	Command string
+	Value   string `json:",omitempty"`
+	Result  string
+	Message string `json:",omitempty"`
+}
+
+/*
+Parse a command as text (e.g. "set_delay 30") or JSON (e.g.
+{"command": "set_delay", "value": "30"}).
+*/
+func parseCommand(payload []byte) (*Command, error) {
+	command := new(Command)
+	text := strings.TrimSpace(string(payload))
+	if strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal([]byte(text), command); err != nil {
+			return nil, err
+		}
+	} else {
+		name, value, _ := strings.Cut(text, " ")
+		command.Name = name
+		command.Value = strings.TrimSpace(value)
+	}
+	command.Name = strings.ToLower(strings.TrimSpace(command.Name))
+	if command.Name == "" {
+		return nil, errors.New("empty command")
+	}
+	return command, nil
+}
+
+/* Set while the inverter is initialised by the reinit command. */
+var reinitializing atomic.Bool
+
+/*
+Execute a command and acknowledge it. The initialisation of the inverter
+takes seconds, so reinit runs on its own goroutine and does not hold up
+the publications.
+*/
+func (p *Publisher) run(command *Command, reader *reader.Reader) {
+	if command.Name != "reinit" {
+		command.Done(p.execute(command, reader))
+		return
+	}
+	if !reinitializing.CompareAndSwap(false, true) {
+		command.Done("", errors.New("initialisation of the inverter already running"))
+		return
+	}
+	diag.Info("Executing command " + command.Name)
+	go func() {
+		defer reinitializing.Store(false)
+		if err := reader.InitLogger(); err != nil {
+			command.Done("", fmt.Errorf("initialisation of the inverter failed: %w", err))
+			return
+		}
+		command.Done("inverter initialised", nil)
+	}()
+}
+
+/* Execute a command; returns the result for the acknowledgement. */
+func (p *Publisher) execute(command *Command, reader *reader.Reader) (string, error) {
+	diag.Info("Executing command " + command.Name + " " + command.Value)
+	switch command.Name {
+	case "republish":
+		p.republish = true
+		return "all values republished", nil
+	case "set_delay":
+		seconds, err := strconv.Atoi(command.Value)
+		if err != nil || seconds < 0 {
+			return "", fmt.Errorf("invalid delay %q", command.Value)
+		}
+		for _, sink := range p.sinks {
+			if sink.info.Name == "mqtt" {
+				sink.setInterval(time.Duration(seconds) * time.Second)
+			}
+		}
+		return fmt.Sprintf("delay set to %d seconds", seconds), nil
+	case "set_precision":
+		decimals, err := strconv.Atoi(command.Value)
+		if err != nil || decimals < -1 {
+			return "", fmt.Errorf("invalid precision %q", command.Value)
+		}
+		for _, sink := range p.sinks {
+			if setter, ok := sink.sink.(PrecisionSetter); ok {
+				setter.SetPrecision(decimals)
+			}
+		}
+		return fmt.Sprintf("precision set to %d", decimals), nil
+	case "verbose":
+		switch strings.ToLower(command.Value) {
+		case "on", "true", "1":
+			diag.Verbosive.Store(true)
+		case "off", "false", "0":
+			diag.Verbosive.Store(false)
+		default:
+			return "", fmt.Errorf("invalid verbose %q (on or off)", command.Value)
+		}
+		return "verbose " + strconv.FormatBool(diag.Verbosive.Load()), nil
+	}
+	return "", fmt.Errorf("unknown command %q", command.Name)
+}
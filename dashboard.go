@@ -0,0 +1,23 @@
+// dashboard
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+/* The dashboard, served from the binary so it works without internet access. */
+//go:embed web
+var webFiles embed.FS
+
+/*
+Serve the dashboard on /. Must be registered after the other routes, as
+it matches all paths.
+*/
+func (p *Publisher) routeDashboard(router *mux.Router) {
+	files, _ := fs.Sub(webFiles, "web")
+	router.PathPrefix("/").Handler(http.FileServer(http.FS(files))).Methods("GET")
+}
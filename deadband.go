@@ -0,0 +1,183 @@
+// deadband
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Minimum change of a value before it is published again: absolute (e.g.
+5 W) or relative to the last published value (e.g. 2%).
+*/
+type deadband struct {
+	value   float64
+	percent bool
+}
+
+/* Changes below this are noise of the float32 values. */
+const tolerance = 0.00001
+
+func (d deadband) exceeded(old float64, new float64) bool {
+	diff := math.Abs(new - old)
+	if d.percent {
+		return diff > math.Max(math.Abs(old)*d.value/100, tolerance)
+	}
+	return diff > math.Max(d.value, tolerance)
+}
+
+/* The last value published on the topic of a field. */
+type publishedValue struct {
+	value float64
+	text  string
+	at    time.Time
+}
+
+/*
+Per field settings of the MQTT publication: the deadband, the number of
+decimals and the heartbeat (the maximum period without publishing the
+value). The precision (-precision, -1 if not given) replaces the default
+decimals and may be changed while publishing (set_precision).
+*/
+type fieldSettings struct {
+	deadbands  map[string]deadband
+	decimals   map[string]int
+	heartbeats map[string]time.Duration
+	precision  atomic.Int64
+}
+
+/* Decimals of the fields which need more than one. */
+var defaultDecimals = map[string]int{
+	"Frequency":      2,
+	"SpecificYield":  3,
+	"CapacityFactor": 2,
+}
+
+func parseFieldSettings(deadbands string, decimals string, heartbeats string) (*fieldSettings, error) {
+	settings := &fieldSettings{
+		deadbands:  make(map[string]deadband),
+		decimals:   make(map[string]int),
+		heartbeats: make(map[string]time.Duration),
+	}
+	settings.precision.Store(-1)
+	err := parseFieldList(deadbands, func(field string, value string) error {
+		band := deadband{}
+		value, band.percent = strings.CutSuffix(value, "%")
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid deadband %q of %s", value, field)
+		}
+		band.value = number
+		settings.deadbands[field] = band
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parseFieldList(decimals, func(field string, value string) error {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return fmt.Errorf("invalid decimals %q of %s", value, field)
+		}
+		settings.decimals[field] = number
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parseFieldList(heartbeats, func(field string, value string) error {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid heartbeat %q of %s", value, field)
+		}
+		settings.heartbeats[field] = time.Duration(seconds) * time.Second
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+/*
+Parse a comma separated list of settings per field, e.g. "Power=5,
+Frequency=0.05". A value without field (e.g. "5") or with field "*" is
+the default of all fields.
+*/
+func parseFieldList(list string, parse func(field string, value string) error) error {
+	known := make(map[string]bool)
+	fields := reflect.TypeOf(Datagram{})
+	for i := range fields.NumField() {
+		known[fields.Field(i).Name] = true
+	}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		field, value, found := strings.Cut(item, "=")
+		if !found {
+			field, value = "*", item
+		}
+		field = strings.TrimSpace(field)
+		if field != "*" && !known[field] {
+			return fmt.Errorf("unknown field %q", field)
+		}
+		if err := parse(field, strings.TrimSpace(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fieldSettings) deadband(field string) deadband {
+	if band, found := s.deadbands[field]; found {
+		return band
+	}
+	return s.deadbands["*"]
+}
+
+/*
+The deadband of an integer field (e.g. FaultCode), only if given for the
+field itself: a code is published on every change.
+*/
+func (s *fieldSettings) intDeadband(field string) deadband {
+	return s.deadbands[field]
+}
+
+func (s *fieldSettings) decimalsOf(field string) int {
+	if decimals, found := s.decimals[field]; found {
+		return decimals
+	}
+	if decimals, found := s.decimals["*"]; found {
+		return decimals
+	}
+	if precision := s.precision.Load(); precision >= 0 {
+		return int(precision)
+	}
+	if decimals, found := defaultDecimals[field]; found {
+		return decimals
+	}
+	return 1
+}
+
+/* The value rounded to the decimals of the field and as published. */
+func (s *fieldSettings) round(field string, value float64) (float64, string) {
+	decimals := s.decimalsOf(field)
+	factor := math.Pow10(decimals)
+	rounded := math.Round(value*factor) / factor
+	return rounded, strconv.FormatFloat(rounded, 'f', decimals, 64)
+}
+
+func (s *fieldSettings) heartbeat(field string) time.Duration {
+	if heartbeat, found := s.heartbeats[field]; found {
+		return heartbeat
+	}
+	return s.heartbeats["*"]
+}
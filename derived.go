@@ -0,0 +1,91 @@
+// derived
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"growattrr/diag"
+)
+
+/* Power (kW) assumed for the plausibility of the total without -kwp. */
+const maxInverterPower = 10.0
+
+/* Margin on -kwp, as the array may deliver more than its rating. */
+const powerMargin = 1.25
+
+/*
+Computes the derived values of the datagram: the DC power per string
+(only if the currents are known), the inverter efficiency, the specific
+yield and capacity factor (if the array size is configured), the peak
+power of the day and the lifetime energy. The peak power is reset on a
+new day; the lifetime energy never decreases (e.g. if the inverter
+reports a lower total production after a glitch) and does not follow a
+total production which rose more than possible (see plausibleTotal).
+*/
+func (i *Interpreter) derive(dg *Datagram) {
+	dg.PowerPV1 = dcPower(dg.VoltagePV1, dg.CurrentPV1)
+	dg.PowerPV2 = dcPower(dg.VoltagePV2, dg.CurrentPV2)
+	dg.PowerDC = dg.PowerPV1 + dg.PowerPV2
+	dg.Efficiency = 0
+	if dg.PowerDC > 0 && dg.Power > 0 {
+		dg.Efficiency = float32(roundTo(float64(100*dg.Power/dg.PowerDC), 1))
+	}
+
+	dg.SpecificYield = 0
+	dg.CapacityFactor = 0
+	if arraySize > 0 {
+		dg.SpecificYield = float32(roundTo(float64(dg.DayProduction/float32(arraySize)), 3))
+		dg.CapacityFactor = float32(roundTo(float64(100*dg.DayProduction/float32(arraySize*24)), 2))
+	}
+
+	today := i.rollover.Today()
+	if today != i.peakDay {
+		i.peakDay = today
+		i.peakPower = 0
+	}
+	if dg.Power > i.peakPower {
+		i.peakPower = dg.Power
+	}
+	dg.PeakPower = i.peakPower
+
+	if dg.TotalProduction >= i.lifetime {
+		if i.plausibleTotal(dg.TotalProduction, dg.Timestamp) {
+			i.lifetime = dg.TotalProduction
+			i.lifetimeAt = dg.Timestamp
+			i.implausible = false
+		} else if !i.implausible {
+			i.implausible = true
+			diag.Warn(fmt.Sprintf("Ignoring implausible total production %.1f kWh (lifetime %.1f kWh).",
+				dg.TotalProduction, i.lifetime))
+		}
+	}
+	dg.LifetimeEnergy = i.lifetime
+}
+
+/*
+Whether the total production can have risen this much since the lifetime
+energy was last confirmed: at most the rated power (-kwp with a margin,
+otherwise maxInverterPower) over the elapsed time, plus one step of the
+counter (0.1 kWh, with some rounding). The first total is always
+accepted.
+*/
+func (i *Interpreter) plausibleTotal(total float32, at time.Time) bool {
+	if i.lifetime == 0 || i.lifetimeAt.IsZero() {
+		return true
+	}
+	power := maxInverterPower
+	if arraySize > 0 {
+		power = arraySize * powerMargin
+	}
+	hours := max(at.Sub(i.lifetimeAt).Hours(), 0)
+	return float64(total-i.lifetime) <= power*hours+0.15
+}
+
+/* DC power of a string in W. Zero if the current is unknown. */
+func dcPower(voltage float32, current float32) float32 {
+	if current <= 0 || voltage <= 0 {
+		return 0
+	}
+	return float32(roundTo(float64(voltage*current), 1))
+}
@@ -2,10 +2,12 @@ package diag
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
-var Verbosive = false
+// Verbosive may be switched while running (e.g. by a command)
+var Verbosive atomic.Bool
 
 func writeMessage(msg string, ctx string) {
 	now := time.Now().Format("15:04")
@@ -21,7 +23,7 @@ func Info(msg string) {
 }
 
 func Verbose(msg string) {
-	if Verbosive {
+	if Verbosive.Load() {
 		writeMessage(msg, "[----]")
 	}
 }
@@ -0,0 +1,17 @@
+package diag
+
+import "sync/atomic"
+
+// Counters of the internal processing, e.g. for monitoring.
+var (
+	BytesRead      atomic.Int64
+	LastRead       atomic.Int64 // Unix time of the last successful read
+	LastDatagram   atomic.Int64 // Unix time of the last valid datagram
+	QueueOverflows atomic.Int64
+	Reconnects     atomic.Int64
+	InitAttempts   atomic.Int64
+	InitFailures   atomic.Int64
+	FramesDecoded  atomic.Int64
+	InvalidFrames  atomic.Int64
+	Resyncs        atomic.Int64
+)
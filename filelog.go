@@ -0,0 +1,311 @@
+// filelog
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"growattrr/diag"
+)
+
+func init() {
+	RegisterSink("file", newFileSink)
+}
+
+func newFileSink(env *SinkEnv) (Sink, SinkOptions) {
+	options := SinkOptions{Interval: time.Duration(logInterval) * time.Second, Policy: PublishNew}
+	if logFormat == "" {
+		return nil, options
+	}
+	dir := logDir
+	if dir == "" {
+		dir = dataPath("log")
+	}
+	if dir == "" {
+		diag.Warn("No directory for the file log.")
+		return nil, options
+	}
+	logger := NewFileLogger(dir, logFormat, logColumns, logMaxMB, env.Rollover.Location())
+	if logger == nil {
+		return nil, options
+	}
+	return logger, options
+}
+
+/*
+Appends each datagram as CSV or JSON lines to a file per day. Files of
+previous days are compressed (gzip) and the oldest files are removed if
+the files exceed the maximum disk usage. If the file of today alone
+exceeds it, logging stops until the next day.
+*/
+type FileLogger struct {
+	dir       string
+	format    string
+	columns   []string
+	maxBytes  int64
+	total     int64
+	full      bool
+	location  *time.Location
+	day       string
+	file      *os.File
+	lastWrite time.Time
+}
+
+/*
+Create a file logger in dir for the format (csv or jsonl). The columns
+are the datagram fields to log; all fields if empty.
+*/
+func NewFileLogger(dir string, format string, columns string, maxMB int, location *time.Location) *FileLogger {
+	if format != "csv" && format != "jsonl" {
+		diag.Warn("Unknown log format '" + format + "' (csv or jsonl).")
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		diag.Warn("Cannot create log directory: " + err.Error())
+		return nil
+	}
+	f := new(FileLogger)
+	f.dir = dir
+	f.format = format
+	f.maxBytes = int64(maxMB) * 1024 * 1024
+	f.location = location
+	fields := reflect.TypeOf(Datagram{})
+	if columns != "" {
+		for _, column := range strings.Split(columns, ",") {
+			column = strings.TrimSpace(column)
+			if _, known := fields.FieldByName(column); !known {
+				diag.Warn("Unknown log column '" + column + "'.")
+				return nil
+			}
+			f.columns = append(f.columns, column)
+		}
+	} else {
+		f.columns = []string{"Timestamp"}
+		for i := range fields.NumField() {
+			if fields.Field(i).Name != "Timestamp" {
+				f.columns = append(f.columns, fields.Field(i).Name)
+			}
+		}
+	}
+	diag.Info("Logging " + format + " to " + dir)
+	return f
+}
+
+func (f *FileLogger) Init() error {
+	return nil
+}
+
+func (f *FileLogger) PublishDatagram(data *Datagram, forced bool) error {
+	return f.Write(data)
+}
+
+func (f *FileLogger) PublishStatus(status *Status) error {
+	return nil
+}
+
+/*
+Write the datagram, unless it has been written before.
+*/
+func (f *FileLogger) Write(dg *Datagram) error {
+	if !dg.Timestamp.After(f.lastWrite) {
+		return nil
+	}
+	f.lastWrite = dg.Timestamp
+
+	today := dayOf(dg.Timestamp.In(f.location))
+	if today != f.day || f.file == nil {
+		if err := f.rotate(today); err != nil {
+			return err
+		}
+	}
+	if f.maxBytes > 0 && f.total > f.maxBytes && !f.full {
+		f.limit()
+	}
+	if f.full {
+		return nil
+	}
+
+	values := datagramFields(dg)
+	if f.format == "csv" {
+		info, _ := f.file.Stat()
+		if info != nil && info.Size() == 0 {
+			if err := f.writeCsv(f.columns); err != nil {
+				return err
+			}
+		}
+		row := make([]string, len(f.columns))
+		for i, column := range f.columns {
+			row[i] = values[column]
+		}
+		return f.writeCsv(row)
+	}
+
+	selected := make(map[string]json.RawMessage, len(f.columns))
+	for _, column := range f.columns {
+		if value, ok := values[column]; ok {
+			if _, err := strconv.ParseFloat(value, 64); err == nil {
+				selected[column] = json.RawMessage(value)
+			} else {
+				selected[column], _ = json.Marshal(value)
+			}
+		}
+	}
+	line, _ := json.Marshal(selected)
+	written, err := f.file.Write(append(line, '\n'))
+	f.total += int64(written)
+	return err
+}
+
+func (f *FileLogger) writeCsv(row []string) error {
+	counter := &countingWriter{writer: f.file}
+	writer := csv.NewWriter(counter)
+	_ = writer.Write(row)
+	writer.Flush()
+	f.total += counter.count
+	return writer.Error()
+}
+
+/* Counts the bytes written, to keep track of the disk usage. */
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	written, err := c.writer.Write(data)
+	c.count += int64(written)
+	return written, err
+}
+
+/* Close the current file. */
+func (f *FileLogger) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+/*
+Open the file of the day, compress the files of previous days and
+enforce the maximum disk usage.
+*/
+func (f *FileLogger) rotate(today string) error {
+	_ = f.Close()
+	f.day = today
+	f.full = false
+
+	name := filepath.Join(f.dir, "growatt-"+today+"."+f.format)
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		diag.Warn("Cannot open log: " + err.Error())
+		return err
+	}
+	f.file = file
+
+	files, _ := filepath.Glob(filepath.Join(f.dir, "growatt-*."+f.format))
+	for _, old := range files {
+		if old != name {
+			compress(old)
+		}
+	}
+	f.limit()
+	return nil
+}
+
+/*
+Remove the oldest files while the total size exceeds the maximum. Called
+on rotation and whenever the writes since exceed the maximum.
+*/
+func (f *FileLogger) limit() {
+	if f.maxBytes <= 0 {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(f.dir, "growatt-*"))
+	sort.Strings(files)
+
+	var total int64
+	sizes := make(map[string]int64)
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			sizes[file] = info.Size()
+			total += info.Size()
+		}
+	}
+	for _, file := range files {
+		if total <= f.maxBytes || file == f.file.Name() {
+			break
+		}
+		diag.Info("Removing log " + file)
+		if os.Remove(file) == nil {
+			total -= sizes[file]
+		}
+	}
+	f.total = total
+	if total > f.maxBytes && !f.full {
+		diag.Warn("The log of today exceeds the maximum size; logging stops until tomorrow.")
+		f.full = true
+	}
+}
+
+/* Compress the file with gzip and remove the original. */
+func compress(name string) {
+	source, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer source.Close()
+
+	target, err := os.Create(name + ".gz")
+	if err != nil {
+		diag.Warn("Cannot compress log: " + err.Error())
+		return
+	}
+	writer := gzip.NewWriter(target)
+	_, err = io.Copy(writer, source)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		diag.Warn("Cannot compress log: " + err.Error())
+		_ = os.Remove(name + ".gz")
+		return
+	}
+	_ = os.Remove(name)
+}
+
+/* The fields of the datagram formatted as text by field name. */
+func datagramFields(dg *Datagram) map[string]string {
+	values := make(map[string]string)
+	fields := reflect.TypeOf(*dg)
+	elements := reflect.ValueOf(*dg)
+	for i := range fields.NumField() {
+		name := fields.Field(i).Name
+		element := elements.Field(i)
+		switch element.Kind() {
+		case reflect.Float32:
+			values[name] = strconv.FormatFloat(element.Float(), 'f', -1, 32)
+		case reflect.Int:
+			values[name] = strconv.Itoa(int(element.Int()))
+		case reflect.String:
+			values[name] = element.String()
+		default:
+			timeValue, _ := element.Interface().(time.Time)
+			values[name] = timeValue.Format(time.RFC3339)
+		}
+	}
+	return values
+}
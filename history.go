@@ -0,0 +1,559 @@
+// history
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"growattrr/diag"
+)
+
+/*
+Aggregate of the datagrams within a period (a step from Start). For each
+numeric field of the datagram the average, minimum and maximum are kept.
+*/
+type Aggregate struct {
+	Start             time.Time
+	Step              string
+	Samples           int
+	Minutes           int
+	ProductionMinutes int `json:",omitempty"`
+	Avg               map[string]float64
+	Min               map[string]float64
+	Max               map[string]float64
+	PeakTime          *time.Time `json:",omitempty"`
+	FirstProduction   *time.Time `json:",omitempty"`
+	LastProduction    *time.Time `json:",omitempty"`
+	Faults            int        `json:",omitempty"`
+	FaultCodes        []int      `json:",omitempty"`
+}
+
+/* A level of the history with its own resolution and retention. */
+type tier struct {
+	name      string
+	step      time.Duration
+	retention int
+	current   *accumulator
+}
+
+/*
+Append-only history of all accepted datagrams on disk. The datagrams are
+kept per day (raw) as well as aggregated per minute, per 15 minutes and
+per day. Each level is cleaned up after its retention (in days, 0 keeps
+it forever).
+*/
+type History struct {
+	dir       string
+	location  *time.Location
+	lock      *sync.Mutex
+	incoming  chan *Datagram
+	retention int
+	tiers     []*tier
+	rawDay    string
+	rawFile   *os.File
+	cleanDay  string
+	faulted   bool
+}
+
+const oneDay = 24 * time.Hour
+
+/*
+Create a history in the given directory. Returns nil if no directory is
+given, which disables the history.
+*/
+func NewHistory(dir string, rollover *Rollover) *History {
+	if dir == "" {
+		return nil
+	}
+	h := new(History)
+	h.dir = dir
+	h.location = rollover.Location()
+	h.lock = &sync.Mutex{}
+	h.incoming = make(chan *Datagram, 1000)
+	h.retention = retentionRaw
+	h.tiers = []*tier{
+		{name: "1m", step: time.Minute, retention: retention1m},
+		{name: "15m", step: 15 * time.Minute, retention: retention15m},
+		{name: "daily", step: oneDay, retention: retentionDaily},
+	}
+	for _, name := range []string{"raw", "1m", "15m", "daily"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			diag.Warn("Cannot create history: " + err.Error())
+			return nil
+		}
+	}
+	go h.start()
+	return h
+}
+
+/*
+Add an accepted datagram to the history. It is written asynchronously;
+if writing can not keep up, the datagram is dropped.
+*/
+func (h *History) Add(dg *Datagram) {
+	select {
+	case h.incoming <- dg:
+	default:
+		diag.Verbose("History is full; dropping datagram.")
+	}
+}
+
+func (h *History) start() {
+	diag.Info("Start history in " + h.dir)
+	h.cleanup()
+	h.lock.Lock()
+	h.restore()
+	h.lock.Unlock()
+	for dg := range h.incoming {
+		h.lock.Lock()
+		h.store(dg)
+		h.lock.Unlock()
+	}
+}
+
+/*
+Close the files, e.g. on termination. The open aggregates are not written,
+as these are partial; these are restored from the raw datagrams of today
+on the next start (see restore).
+*/
+func (h *History) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, t := range h.tiers {
+		t.current = nil
+	}
+	if h.rawFile != nil {
+		h.rawFile.Close()
+		h.rawFile = nil
+	}
+}
+
+func (h *History) store(dg *Datagram) {
+	timestamp := dg.Timestamp.In(h.location)
+	today := dayOf(timestamp)
+
+	if today != h.rawDay {
+		if h.rawFile != nil {
+			h.rawFile.Close()
+		}
+		h.rawDay = today
+		file, err := os.OpenFile(h.path("raw", today), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			diag.Warn("Cannot write history: " + err.Error())
+		}
+		h.rawFile = file
+	}
+	if h.rawFile != nil {
+		line, _ := json.Marshal(dg)
+		_, _ = h.rawFile.Write(append(line, '\n'))
+	}
+
+	h.aggregate(dg, nil)
+
+	if today != h.cleanDay {
+		h.cleanup()
+	}
+}
+
+/*
+Add the datagram to the open aggregate of each level, writing the
+aggregates of which the period has passed. Levels of which the bucket
+was written already (as given per level) are skipped.
+*/
+func (h *History) aggregate(dg *Datagram, written map[*tier]time.Time) {
+	faulty := dg.FaultCode > 0 || dg.Status == "Fault"
+	entered := faulty && !h.faulted
+	h.faulted = faulty
+
+	timestamp := dg.Timestamp.In(h.location)
+	for _, t := range h.tiers {
+		start := h.bucketStart(timestamp, t.step)
+		if last, found := written[t]; found && !start.After(last) {
+			continue
+		}
+		if t.current != nil && !t.current.agg.Start.Equal(start) {
+			h.appendAggregate(t, t.current.result())
+			t.current = nil
+		}
+		if t.current == nil {
+			t.current = newAccumulator(start, t.step)
+		}
+		t.current.add(dg, entered)
+	}
+}
+
+/*
+Restore the open aggregates from the raw datagrams of yesterday and
+today, after the last aggregate written of each level. Aggregates of
+which the period passed while not running are written.
+*/
+func (h *History) restore() {
+	now := time.Now().In(h.location)
+	days := []string{dayOf(now.AddDate(0, 0, -1)), dayOf(now)}
+	written := make(map[*tier]time.Time)
+	for _, t := range h.tiers {
+		keys := days
+		if t.step >= oneDay {
+			keys = []string{days[0][:4], days[1][:4]}
+		}
+		for n, key := range keys {
+			if n > 0 && key == keys[n-1] {
+				continue
+			}
+			h.readLines(t.name, key, func(line []byte) {
+				agg := new(Aggregate)
+				if json.Unmarshal(line, agg) == nil && agg.Start.After(written[t]) {
+					written[t] = agg.Start
+				}
+			})
+		}
+	}
+	for _, day := range days {
+		h.readLines("raw", day, func(line []byte) {
+			dg := new(Datagram)
+			if json.Unmarshal(line, dg) == nil {
+				h.aggregate(dg, written)
+			}
+		})
+	}
+}
+
+func (h *History) appendAggregate(t *tier, agg *Aggregate) {
+	key := dayOf(agg.Start)
+	if t.step >= oneDay {
+		key = agg.Start.Format("2006")
+	}
+	file, err := os.OpenFile(h.path(t.name, key), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		diag.Warn("Cannot write history: " + err.Error())
+		return
+	}
+	defer file.Close()
+	line, _ := json.Marshal(agg)
+	_, _ = file.Write(append(line, '\n'))
+}
+
+/* Remove the files which are beyond their retention. */
+func (h *History) cleanup() {
+	now := time.Now().In(h.location)
+	h.cleanDay = dayOf(now)
+
+	levels := map[string]int{"raw": h.retention}
+	for _, t := range h.tiers {
+		levels[t.name] = t.retention
+	}
+	for name, retention := range levels {
+		if retention <= 0 {
+			continue
+		}
+		limit := dayOf(now.AddDate(0, 0, -retention))
+		if name == "daily" {
+			limit = now.AddDate(0, 0, -retention).Format("2006")
+		}
+		files, _ := filepath.Glob(filepath.Join(h.dir, name, "*.jsonl"))
+		for _, file := range files {
+			key := strings.TrimSuffix(filepath.Base(file), ".jsonl")
+			if key < limit {
+				diag.Verbose("Removing history " + file)
+				_ = os.Remove(file)
+			}
+		}
+	}
+}
+
+func (h *History) path(level string, key string) string {
+	return filepath.Join(h.dir, level, key+".jsonl")
+}
+
+/*
+Start of the bucket of the given step, relative to the start of the day
+in the time zone of the history.
+*/
+func (h *History) bucketStart(t time.Time, step time.Duration) time.Time {
+	local := t.In(h.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, h.location)
+	if step >= oneDay {
+		return midnight
+	}
+	return midnight.Add(local.Sub(midnight) / step * step)
+}
+
+/*
+Query the history between from and to, aggregated per step. The data is
+taken from the coarsest level which fits the step and covers the period.
+The step should divide a day (at most one day): the buckets start at
+multiples of the step from midnight.
+*/
+func (h *History) Query(from time.Time, to time.Time, step time.Duration) []*Aggregate {
+	if step <= 0 {
+		step = time.Minute
+	}
+	buckets := make(map[time.Time]*accumulator)
+	collect := func(start time.Time) *accumulator {
+		bucket := h.bucketStart(start, step)
+		acc, ok := buckets[bucket]
+		if !ok {
+			acc = newAccumulator(bucket, step)
+			buckets[bucket] = acc
+		}
+		return acc
+	}
+
+	h.lock.Lock()
+	source := h.source(from, step)
+	var open *accumulator
+	if source != nil && source.current != nil {
+		open = source.current.copy()
+	}
+	h.lock.Unlock()
+
+	if source == nil {
+		faulted := false
+		for _, key := range h.keys("raw", from, to) {
+			h.readLines("raw", key, func(line []byte) {
+				dg := new(Datagram)
+				if json.Unmarshal(line, dg) == nil && !dg.Timestamp.Before(from) && dg.Timestamp.Before(to) {
+					faulty := dg.FaultCode > 0 || dg.Status == "Fault"
+					collect(dg.Timestamp).add(dg, faulty && !faulted)
+					faulted = faulty
+				}
+			})
+		}
+	} else {
+		aggregates := make([]*Aggregate, 0)
+		for _, key := range h.keys(source.name, from, to) {
+			h.readLines(source.name, key, func(line []byte) {
+				agg := new(Aggregate)
+				if json.Unmarshal(line, agg) == nil {
+					aggregates = append(aggregates, agg)
+				}
+			})
+		}
+		if open != nil {
+			aggregates = append(aggregates, open.result())
+		}
+		first := h.bucketStart(from, source.step)
+		for _, agg := range aggregates {
+			if !agg.Start.Before(first) && agg.Start.Before(to) {
+				collect(agg.Start).merge(agg)
+			}
+		}
+	}
+
+	result := make([]*Aggregate, 0, len(buckets))
+	for _, acc := range buckets {
+		result = append(result, acc.result())
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].Start.Before(result[b].Start) })
+	return result
+}
+
+/*
+The level to query for the period and step: the coarsest level of which
+the step fits the requested step, falling back to a coarser level if
+the data is beyond retention. Nil means the raw datagrams.
+*/
+func (h *History) source(from time.Time, step time.Duration) *tier {
+	var source *tier
+	for _, t := range h.tiers {
+		if step >= t.step && step%t.step == 0 {
+			source = t
+		}
+	}
+	covers := func(retention int) bool {
+		return retention <= 0 || from.After(time.Now().AddDate(0, 0, -retention))
+	}
+	if source == nil && covers(h.retention) {
+		return nil
+	}
+	for _, t := range h.tiers {
+		if (source == nil || t.step >= source.step) && covers(t.retention) {
+			return t
+		}
+	}
+	return h.tiers[len(h.tiers)-1]
+}
+
+/* The file keys of the level between from and to. */
+func (h *History) keys(level string, from time.Time, to time.Time) []string {
+	keys := make([]string, 0)
+	format := "2006-01-02"
+	if level == "daily" {
+		format = "2006"
+	}
+	first := from.In(h.location)
+	for t := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, h.location); t.Before(to); t = t.AddDate(0, 0, 1) {
+		key := t.Format(format)
+		if len(keys) == 0 || keys[len(keys)-1] != key {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (h *History) readLines(level string, key string, handle func([]byte)) {
+	file, err := os.Open(h.path(level, key))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		handle(scanner.Bytes())
+	}
+}
+
+/*
+Accumulates datagrams or aggregates to a single aggregate.
+*/
+type accumulator struct {
+	agg            *Aggregate
+	sums           map[string]float64
+	lastMinute     int64
+	lastProduction int64
+}
+
+func newAccumulator(start time.Time, step time.Duration) *accumulator {
+	a := new(accumulator)
+	a.agg = &Aggregate{
+		Start: start,
+		Step:  step.String(),
+		Min:   make(map[string]float64),
+		Max:   make(map[string]float64),
+	}
+	a.sums = make(map[string]float64)
+	a.lastMinute = -1
+	a.lastProduction = -1
+	return a
+}
+
+/*
+Add a datagram. Entered tells whether the inverter went into fault with
+this datagram; Faults counts these transitions, not the datagrams.
+*/
+func (a *accumulator) add(dg *Datagram, entered bool) {
+	a.agg.Samples++
+	minute := dg.Timestamp.Unix() / 60
+	if minute != a.lastMinute {
+		a.agg.Minutes++
+		a.lastMinute = minute
+	}
+
+	values := datagramValues(dg)
+	for name, value := range values {
+		a.sums[name] += value
+		a.observe(name, value, value)
+	}
+	timestamp := dg.Timestamp
+	if values["Power"] >= a.agg.Max["Power"] {
+		a.agg.PeakTime = &timestamp
+	}
+	if dg.Power > 0 {
+		a.production(timestamp, timestamp)
+		if minute != a.lastProduction {
+			a.agg.ProductionMinutes++
+			a.lastProduction = minute
+		}
+	}
+	if entered {
+		a.agg.Faults++
+	}
+	if dg.FaultCode > 0 || dg.Status == "Fault" {
+		a.fault(dg.FaultCode)
+	}
+}
+
+func (a *accumulator) merge(other *Aggregate) {
+	if other.Max["Power"] >= a.agg.Max["Power"] && other.PeakTime != nil {
+		a.agg.PeakTime = other.PeakTime
+	}
+	a.agg.Samples += other.Samples
+	a.agg.Minutes += other.Minutes
+	a.agg.ProductionMinutes += other.ProductionMinutes
+	for name, value := range other.Avg {
+		a.sums[name] += value * float64(other.Samples)
+		a.observe(name, other.Min[name], other.Max[name])
+	}
+	if other.FirstProduction != nil {
+		a.production(*other.FirstProduction, *other.LastProduction)
+	}
+	a.agg.Faults += other.Faults
+	for _, code := range other.FaultCodes {
+		a.fault(code)
+	}
+}
+
+func (a *accumulator) observe(name string, low float64, high float64) {
+	if current, ok := a.agg.Min[name]; !ok || low < current {
+		a.agg.Min[name] = low
+	}
+	if current, ok := a.agg.Max[name]; !ok || high > current {
+		a.agg.Max[name] = high
+	}
+}
+
+func (a *accumulator) production(first time.Time, last time.Time) {
+	if a.agg.FirstProduction == nil || first.Before(*a.agg.FirstProduction) {
+		a.agg.FirstProduction = &first
+	}
+	if a.agg.LastProduction == nil || last.After(*a.agg.LastProduction) {
+		a.agg.LastProduction = &last
+	}
+}
+
+func (a *accumulator) fault(code int) {
+	for _, known := range a.agg.FaultCodes {
+		if known == code {
+			return
+		}
+	}
+	a.agg.FaultCodes = append(a.agg.FaultCodes, code)
+}
+
+func (a *accumulator) copy() *accumulator {
+	c := newAccumulator(a.agg.Start, time.Minute)
+	c.merge(a.result())
+	c.agg.Step = a.agg.Step
+	return c
+}
+
+func (a *accumulator) result() *Aggregate {
+	result := *a.agg
+	result.Avg = make(map[string]float64, len(a.sums))
+	if result.Samples > 0 {
+		for name, sum := range a.sums {
+			result.Avg[name] = roundTo(sum/float64(result.Samples), 3)
+		}
+	}
+	return &result
+}
+
+/* The numeric values of the datagram by field name. */
+func datagramValues(dg *Datagram) map[string]float64 {
+	values := make(map[string]float64)
+	fields := reflect.TypeOf(*dg)
+	elements := reflect.ValueOf(*dg)
+	for i := range fields.NumField() {
+		switch fields.Field(i).Type.Kind() {
+		case reflect.Float32:
+			values[fields.Field(i).Name] = roundTo(elements.Field(i).Float(), 3)
+		case reflect.Int:
+			values[fields.Field(i).Name] = float64(elements.Field(i).Int())
+		}
+	}
+	return values
+}
+
+func roundTo(value float64, decimals int) float64 {
+	factor := math.Pow10(decimals)
+	return math.Round(value*factor) / factor
+}
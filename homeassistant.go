@@ -0,0 +1,255 @@
+// homeassistant
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"growattrr/diag"
+)
+
+/*
+A field of the datagram as announced to Home Assistant. Precision is the
+suggested number of decimals (-1 for none). The component is sensor,
+unless given (e.g. binary_sensor). Daily energy is reset at the start of
+each production day.
+*/
+type ChannelConfig struct {
+	name      string
+	device    string
+	unit      string
+	state     string
+	category  string
+	precision int
+	component string
+	daily     bool
+}
+
+func HomeAssistantConfig() []ChannelConfig {
+	return []ChannelConfig{
+		{name: "Power", device: "power", unit: "W", state: "measurement", precision: 0},
+		{name: "VoltagePV1", device: "voltage", unit: "V", state: "measurement", precision: 1},
+		{name: "VoltagePV2", device: "voltage", unit: "V", state: "measurement", precision: 1},
+		{name: "VoltageBus", device: "voltage", unit: "V", state: "measurement", precision: 1},
+		{name: "VoltageGrid", device: "voltage", unit: "V", state: "measurement", precision: 1},
+		{name: "TotalProduction", device: "energy", unit: "kWh", state: "total", precision: 1},
+		{name: "DayProduction", device: "energy", unit: "kWh", state: "total_increasing", precision: 1, daily: true},
+		{name: "Frequency", device: "frequency", unit: "Hz", state: "measurement", precision: 2},
+		{name: "Temperature", device: "temperature", unit: "°C", state: "measurement", precision: 1},
+		{name: "OperationHours", device: "duration", unit: "h", state: "total", category: "diagnostic", precision: 0},
+		{name: "Status", category: "diagnostic", precision: -1},
+		{name: "FaultCode", category: "diagnostic", precision: -1},
+		{name: "SpecificYield", unit: "kWh/kWp", state: "measurement", precision: 2},
+		{name: "CapacityFactor", unit: "%", state: "measurement", precision: 1},
+		{name: "PeakPower", device: "power", unit: "W", precision: 0},
+		{name: "DayEnergy", device: "energy", unit: "Wh", state: "total_increasing", precision: 0, daily: true},
+		{name: "EnergyDeviation", device: "energy", unit: "Wh", precision: 0},
+		{name: "LifetimeEnergy", device: "energy", unit: "kWh", state: "total_increasing", precision: 1},
+		{name: "Timestamp", device: "timestamp", precision: -1}}
+}
+
+/*
+The health of the reader as announced to Home Assistant, taken from the
+diagnostics (see Diagnostics).
+*/
+func HomeAssistantDiagnostics() []ChannelConfig {
+	return []ChannelConfig{
+		{name: "Reader", category: "diagnostic", precision: -1},
+		{name: "Interpreter", category: "diagnostic", precision: -1},
+		{name: "Publisher", category: "diagnostic", precision: -1},
+		{name: "Init", category: "diagnostic", precision: -1},
+		{name: "InvalidFrames", state: "total_increasing", category: "diagnostic", precision: 0},
+		{name: "Reconnects", state: "total_increasing", category: "diagnostic", precision: 0},
+		{name: "LastReadAge", device: "duration", unit: "s", state: "measurement", category: "diagnostic", precision: 0},
+		{name: "Communicating", device: "connectivity", category: "diagnostic", precision: -1, component: "binary_sensor"}}
+}
+
+/* The device of the entities in Home Assistant. */
+type haDevice struct {
+	Name         string   `json:"name"`
+	Identifiers  []string `json:"identifiers"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SwVersion    string   `json:"sw_version"`
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+/* The discovery payload of an entity. */
+type haEntity struct {
+	Name                      string           `json:"name"`
+	UniqueID                  string           `json:"unique_id"`
+	DefaultEntityID           string           `json:"default_entity_id"`
+	StateTopic                string           `json:"state_topic"`
+	ValueTemplate             string           `json:"value_template,omitempty"`
+	LastResetValueTemplate    string           `json:"last_reset_value_template,omitempty"`
+	DeviceClass               string           `json:"device_class,omitempty"`
+	UnitOfMeasurement         string           `json:"unit_of_measurement,omitempty"`
+	StateClass                string           `json:"state_class,omitempty"`
+	EntityCategory            string           `json:"entity_category,omitempty"`
+	SuggestedDisplayPrecision *int             `json:"suggested_display_precision,omitempty"`
+	Availability              []haAvailability `json:"availability"`
+	Device                    haDevice         `json:"device"`
+}
+
+/* Topic on which Home Assistant announces its (re)start. */
+const haStatusTopic = "homeassistant/status"
+
+/*
+The identity of the inverter in Home Assistant, derived from the site
+and inverter name, e.g. growatt_home_roof. Entities of several inverters
+do not collide as long as these have different names.
+*/
+func haIdentity() string {
+	name := inverterName()
+	if site != "" {
+		name = site + "_" + name
+	}
+	return "growatt_" + haName(name)
+}
+
+/* A name usable in IDs and topics: lower case ASCII letters, digits and _. */
+func haName(name string) string {
+	var result strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+			result.WriteRune(c)
+		} else {
+			result.WriteRune('_')
+		}
+	}
+	return result.String()
+}
+
+/*
+Announce the fields and publish all values again once Home Assistant is
+(re)started, as it does not know the values which are not retained.
+*/
+func (m *MqttSink) subscribeHomeAssist() {
+	m.client.Subscribe(haStatusTopic, 1, func(message *mqttMessage) {
+		if string(message.Payload) != "online" {
+			return
+		}
+		// Do not block the client while waiting for the discovery
+		go func() {
+			if err := m.discoveryHomeAssist(); err != nil {
+				diag.Warn("Discovery for Home Assistant failed: " + err.Error())
+			}
+			republish := &Command{Name: "republish", Done: func(string, error) {}}
+			select {
+			case m.env.Commands <- republish:
+			default:
+				diag.Warn("Values not republished for Home Assistant: too many commands waiting")
+			}
+		}()
+	})
+}
+
+/* Announce the fields as entities of a device to Home Assistant. */
+func (m *MqttSink) discoveryHomeAssist() error {
+	diag.Info("Discovery for Home Assistant")
+
+	identity := haIdentity()
+	device := haDevice{
+		Name:         "Growatt " + inverterName(),
+		Identifiers:  []string{identity},
+		Manufacturer: "Growatt",
+		Model:        "Growatt Reader (RS232)",
+		SwVersion:    Version,
+	}
+	for _, item := range HomeAssistantConfig() {
+		stateTopic, template := m.topicFor(item.name), ""
+		// With the state topic, Home Assistant takes the field from the JSON
+		if m.mode != "fields" {
+			stateTopic = m.stateTopic
+			template = "{{ value_json." + item.name + " if value_json." + item.name + " is defined else none }}"
+		} else if item.daily {
+			// The day topic has the last reset next to the daily energy
+			stateTopic = m.dayTopic
+			template = "{{ value_json." + item.name + " }}"
+		}
+		if err := m.announce(item, device, stateTopic, template); err != nil {
+			return err
+		}
+	}
+	m.removeLegacyDiscovery()
+
+	for _, item := range HomeAssistantDiagnostics() {
+		template := "{{ value_json." + item.name + " }}"
+		if item.component == "binary_sensor" {
+			template = "{{ 'ON' if value_json." + item.name + " else 'OFF' }}"
+		}
+		if err := m.announce(item, device, m.diagnostics, template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Remove the entities as announced by previous versions, once. It is kept
+as done in <datadir>/homeassistant.cleaned, so it is not repeated after
+a restart.
+*/
+func (m *MqttSink) removeLegacyDiscovery() {
+	if m.legacyRemoved.Load() {
+		return
+	}
+	done := dataPath("homeassistant.cleaned")
+	if done != "" {
+		if _, err := os.Stat(done); err == nil {
+			m.legacyRemoved.Store(true)
+			return
+		}
+	}
+	for _, item := range HomeAssistantConfig() {
+		if err := m.publish("discovery", "homeassistant/sensor/"+topic+"/"+item.name+"/config", nil); err != nil {
+			diag.Warn("Removing the previous entities failed: " + err.Error())
+			return
+		}
+	}
+	m.legacyRemoved.Store(true)
+	if done != "" {
+		_ = os.WriteFile(done, []byte(time.Now().Format(time.RFC3339)), 0644)
+	}
+}
+
+/* Announce a single entity. */
+func (m *MqttSink) announce(item ChannelConfig, device haDevice, stateTopic string, template string) error {
+	identity := haIdentity()
+	component := item.component
+	if component == "" {
+		component = "sensor"
+	}
+	entity := haEntity{
+		Name:              item.name,
+		UniqueID:          identity + "_" + snakeCase(item.name),
+		DefaultEntityID:   component + "." + identity + "_" + snakeCase(item.name),
+		StateTopic:        stateTopic,
+		ValueTemplate:     template,
+		DeviceClass:       item.device,
+		UnitOfMeasurement: item.unit,
+		StateClass:        item.state,
+		EntityCategory:    item.category,
+		Availability:      []haAvailability{{Topic: m.availability}},
+		Device:            device,
+	}
+	if item.precision >= 0 {
+		entity.SuggestedDisplayPrecision = &item.precision
+	}
+	// The state and day topics have the last reset of the daily energy
+	if item.daily && (stateTopic == m.stateTopic || stateTopic == m.dayTopic) {
+		entity.StateClass = "total"
+		entity.LastResetValueTemplate = "{{ value_json.DayStart }}"
+	}
+
+	payload, err := json.Marshal(entity)
+	if err != nil {
+		return err
+	}
+	return m.publish("discovery", "homeassistant/"+component+"/"+identity+"/"+snakeCase(item.name)+"/config", payload)
+}
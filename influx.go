@@ -0,0 +1,283 @@
+// influx
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"growattrr/diag"
+)
+
+func init() {
+	RegisterSink("influx", newInfluxSink)
+}
+
+/*
+Writes the datagrams as InfluxDB line protocol (v1 or v2 HTTP API). The
+lines are sent in batches. If the database is unreachable, the batches
+are kept in a buffer file and sent once it is reachable again.
+*/
+type InfluxSink struct {
+	client      *http.Client
+	endpoint    string
+	token       string
+	user        string
+	password    string
+	measurement string
+	tags        string
+	batchSize   int
+	pending     []string
+	lastFlush   time.Time
+	retryAt     time.Time
+	backoff     time.Duration
+	bufferFile  string
+}
+
+/* Maximum size of the buffer file; older lines are dropped beyond it. */
+const influxBufferMax = 50 * 1024 * 1024
+
+/* Lines per request while sending the buffer file. */
+const influxChunk = 1000
+
+/* Maximum number of lines kept in memory if these cannot be buffered. */
+const influxPendingMax = 10000
+
+func newInfluxSink(env *SinkEnv) (Sink, SinkOptions) {
+	options := SinkOptions{Interval: time.Duration(influxInterval) * time.Second, Policy: PublishNew}
+	if influxURL == "" {
+		return nil, options
+	}
+
+	query := url.Values{}
+	query.Set("precision", "s")
+	endpoint := strings.TrimSuffix(influxURL, "/")
+	switch influxVersion {
+	case 1:
+		endpoint += "/write"
+		query.Set("db", influxDatabase)
+	case 2:
+		endpoint += "/api/v2/write"
+		query.Set("org", influxOrg)
+		query.Set("bucket", influxBucket)
+	default:
+		diag.Warn(fmt.Sprintf("Unknown InfluxDB version %d (1 or 2).", influxVersion))
+		return nil, options
+	}
+
+	s := new(InfluxSink)
+	s.client = &http.Client{Timeout: 5 * time.Second}
+	s.endpoint = endpoint + "?" + query.Encode()
+	s.token = influxToken
+	// The v1 credentials are sent as basic authentication, not in the URL
+	if influxVersion == 1 {
+		s.user = influxUser
+		s.password = influxPassword
+	}
+	s.measurement = escapeInflux(influxMeasurement, ", ")
+	s.tags = ",inverter=" + escapeInflux(inverterName(), ",= ")
+	if site != "" {
+		s.tags += ",site=" + escapeInflux(site, ",= ")
+	}
+	s.batchSize = max(1, influxBatch)
+	s.bufferFile = dataPath("influx-buffer.lp")
+	s.lastFlush = time.Now()
+	diag.Info(fmt.Sprintf("Writing to InfluxDB v%d on %s", influxVersion, influxURL))
+	return s, options
+}
+
+func (s *InfluxSink) Init() error {
+	return nil
+}
+
+func (s *InfluxSink) PublishStatus(status *Status) error {
+	return nil
+}
+
+/*
+Add the datagram to the batch and send the batch if it is full or has
+been waiting for a minute.
+*/
+func (s *InfluxSink) PublishDatagram(data *Datagram, forced bool) error {
+	s.pending = append(s.pending, s.line(data))
+	if len(s.pending) < s.batchSize && time.Since(s.lastFlush) < time.Minute {
+		return nil
+	}
+	return s.flush()
+}
+
+/* Send the pending lines, or buffer them on failure. */
+func (s *InfluxSink) Close() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	s.retryAt = time.Time{}
+	return s.flush()
+}
+
+/*
+Send the buffer file and the pending lines. After a failure the lines
+are buffered and sending is retried with an increasing delay.
+*/
+func (s *InfluxSink) flush() error {
+	if time.Now().Before(s.retryAt) {
+		if len(s.pending) >= influxChunk || len(s.pending) > influxPendingMax {
+			s.buffer()
+		}
+		return nil
+	}
+	s.lastFlush = time.Now()
+
+	err := s.sendBuffer()
+	if err == nil {
+		err = s.send(s.pending)
+	}
+	if err != nil {
+		s.buffer()
+		s.backoff = min(max(2*s.backoff, 10*time.Second), 5*time.Minute)
+		s.retryAt = time.Now().Add(s.backoff)
+		diag.Warn("InfluxDB not available (retry in " + s.backoff.String() + "): " + err.Error())
+		return err
+	}
+	s.pending = s.pending[:0]
+	s.backoff = 0
+	return nil
+}
+
+func (s *InfluxSink) send(lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	request, err := http.NewRequest("POST", s.endpoint, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		request.Header.Set("Authorization", "Token "+s.token)
+	}
+	if s.user != "" {
+		request.SetBasicAuth(s.user, s.password)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 256))
+		return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+/*
+Append the pending lines to the buffer file. Without buffer file (or if
+it cannot be written) the lines are kept in memory, up to
+influxPendingMax lines; the oldest are dropped beyond it.
+*/
+func (s *InfluxSink) buffer() {
+	if len(s.pending) > influxPendingMax {
+		dropped := len(s.pending) - influxPendingMax
+		diag.Warn(fmt.Sprintf("InfluxDB lines pending; dropping the %d oldest.", dropped))
+		s.pending = append(s.pending[:0], s.pending[dropped:]...)
+	}
+	if s.bufferFile == "" || len(s.pending) == 0 {
+		return
+	}
+	if info, err := os.Stat(s.bufferFile); err == nil && info.Size() > influxBufferMax {
+		diag.Warn(fmt.Sprintf("InfluxDB buffer full; dropping %d lines.", len(s.pending)))
+		s.pending = s.pending[:0]
+		return
+	}
+	file, err := os.OpenFile(s.bufferFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		diag.Warn("Cannot buffer InfluxDB lines: " + err.Error())
+		return
+	}
+	defer file.Close()
+	if _, err := file.WriteString(strings.Join(s.pending, "\n") + "\n"); err != nil {
+		diag.Warn("Cannot buffer InfluxDB lines: " + err.Error())
+		return
+	}
+	s.pending = s.pending[:0]
+}
+
+/*
+Send the buffer file in chunks. The lines which could not be sent are
+kept in the buffer file.
+*/
+func (s *InfluxSink) sendBuffer() error {
+	if s.bufferFile == "" {
+		return nil
+	}
+	content, err := os.ReadFile(s.bufferFile)
+	if err != nil || len(content) == 0 {
+		return nil
+	}
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	diag.Info(fmt.Sprintf("Sending %d buffered lines to InfluxDB.", len(lines)))
+
+	for len(lines) > 0 {
+		chunk := lines[:min(influxChunk, len(lines))]
+		if err := s.send(chunk); err != nil {
+			rest := []byte(strings.Join(lines, "\n") + "\n")
+			if writeErr := os.WriteFile(s.bufferFile, rest, 0644); writeErr != nil {
+				diag.Warn("Cannot rewrite InfluxDB buffer: " + writeErr.Error())
+			}
+			return err
+		}
+		lines = lines[len(chunk):]
+	}
+	return os.Remove(s.bufferFile)
+}
+
+/* The datagram in line protocol. */
+func (s *InfluxSink) line(data *Datagram) string {
+	fields := make([]string, 0)
+	types := reflect.TypeOf(*data)
+	values := reflect.ValueOf(*data)
+	for i := range types.NumField() {
+		name := types.Field(i).Name
+		value := values.Field(i)
+		switch value.Kind() {
+		case reflect.Float32:
+			if value.Float() == 0 && types.Field(i).Tag.Get("mqtt") == "omitzero" {
+				continue
+			}
+			fields = append(fields, name+"="+strconv.FormatFloat(value.Float(), 'f', -1, 32))
+		case reflect.Int:
+			fields = append(fields, name+"="+strconv.FormatInt(value.Int(), 10)+"i")
+		case reflect.String:
+			fields = append(fields, name+"=\""+escapeInflux(value.String(), "\"\\")+"\"")
+		}
+	}
+	return fmt.Sprintf("%s%s %s %d", s.measurement, s.tags, strings.Join(fields, ","), data.Timestamp.Unix())
+}
+
+/* Escape the characters with a backslash. */
+func escapeInflux(value string, characters string) string {
+	var result strings.Builder
+	for _, c := range value {
+		if strings.ContainsRune(characters, c) {
+			result.WriteRune('\\')
+		}
+		result.WriteRune(c)
+	}
+	return result.String()
+}
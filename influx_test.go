@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* A stand-in for InfluxDB which accepts the written lines. */
+func newInfluxServer(t *testing.T) *standInServer {
+	return newStandInServer(t, func(w http.ResponseWriter, r *recordedRequest) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+/* The lines written, while the server was not failing. */
+func influxLines(server *standInServer) []string {
+	var lines []string
+	for _, request := range server.received("") {
+		if !request.Failed {
+			lines = append(lines, strings.Split(request.Body, "\n")...)
+		}
+	}
+	return lines
+}
+
+func newTestInfluxSink(t *testing.T, server *standInServer, version int) *InfluxSink {
+	setFlag(t, &influxURL, server.URL)
+	setFlag(t, &influxVersion, version)
+	setFlag(t, &influxDatabase, "solar")
+	setFlag(t, &influxUser, "reader")
+	setFlag(t, &influxPassword, "secret")
+	setFlag(t, &influxBatch, 1)
+	sink, _ := newInfluxSink(&SinkEnv{})
+	if sink == nil {
+		t.Fatal("no InfluxDB sink")
+	}
+	return sink.(*InfluxSink)
+}
+
+func TestInfluxV1BasicAuth(t *testing.T) {
+	server := newInfluxServer(t)
+	sink := newTestInfluxSink(t, server, 1)
+
+	if err := sink.PublishDatagram(&Datagram{Power: 800, Timestamp: time.Unix(1700000000, 0)}, false); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.received("")
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	request := requests[0]
+	if user, password, ok := request.BasicAuth(); !ok || user != "reader" || password != "secret" {
+		t.Errorf("basic auth = %q, %q, %v", user, password, ok)
+	}
+	if query := request.URL.Query(); query.Has("p") || query.Has("u") || query.Get("db") != "solar" {
+		t.Errorf("query = %s", request.URL.RawQuery)
+	}
+	if line := influxLines(server)[0]; !strings.HasPrefix(line, "growatt,inverter=") || !strings.HasSuffix(line, " 1700000000") {
+		t.Errorf("line = %q", line)
+	}
+}
+
+func TestInfluxBufferFile(t *testing.T) {
+	setFlag(t, &datadir, t.TempDir())
+	server := newInfluxServer(t)
+	sink := newTestInfluxSink(t, server, 2)
+
+	server.setFailing(true)
+	if err := sink.PublishDatagram(&Datagram{Power: 1, Timestamp: time.Unix(1, 0)}, false); err == nil {
+		t.Fatal("no error while InfluxDB is unavailable")
+	}
+	if _, err := os.Stat(sink.bufferFile); err != nil {
+		t.Fatalf("lines not buffered: %v", err)
+	}
+
+	server.setFailing(false)
+	sink.retryAt = time.Time{}
+	if err := sink.PublishDatagram(&Datagram{Power: 2, Timestamp: time.Unix(2, 0)}, false); err != nil {
+		t.Fatal(err)
+	}
+	lines := influxLines(server)
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " 1") || !strings.HasSuffix(lines[1], " 2") {
+		t.Errorf("lines = %q", lines)
+	}
+	if _, err := os.Stat(sink.bufferFile); !os.IsNotExist(err) {
+		t.Errorf("buffer file not removed: %v", err)
+	}
+}
+
+func TestInfluxPendingLimit(t *testing.T) {
+	server := newInfluxServer(t)
+	sink := newTestInfluxSink(t, server, 2)
+	server.setFailing(true)
+
+	for i := range influxPendingMax + 100 {
+		_ = sink.PublishDatagram(&Datagram{Power: float32(i), Timestamp: time.Unix(int64(i), 0)}, false)
+	}
+	if len(sink.pending) > influxPendingMax {
+		t.Errorf("%d lines pending, want at most %d", len(sink.pending), influxPendingMax)
+	}
+	if !strings.HasSuffix(sink.pending[len(sink.pending)-1], " 10099") {
+		t.Errorf("latest line dropped: %q", sink.pending[len(sink.pending)-1])
+	}
+}
@@ -0,0 +1,114 @@
+// integrator
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"growattrr/diag"
+)
+
+/*
+Integrates the power over time (trapezoidal) to a day energy in Wh with
+a higher resolution than the 0.1 kWh of the DayProduction counter. No
+energy is integrated over gaps larger than maxGap; after a gap the
+energy is resynchronized with the counter of the inverter.
+*/
+type EnergyIntegrator struct {
+	day       string
+	energy    float64
+	lastTime  time.Time
+	lastPower float32
+	maxGap    time.Duration
+	resync    bool
+	warned    bool
+}
+
+func NewEnergyIntegrator(maxGap time.Duration) *EnergyIntegrator {
+	e := new(EnergyIntegrator)
+	e.maxGap = maxGap
+	e.resync = true
+	return e
+}
+
+/* Restore the energy (Wh) as persisted for the given day. */
+func (e *EnergyIntegrator) Restore(day string, energy float64) {
+	e.day = day
+	e.energy = energy
+	e.resync = true
+}
+
+/* Add a power sample (W) measured at the given time. */
+func (e *EnergyIntegrator) Add(day string, t time.Time, power float32) {
+	e.switchDay(day)
+	if !e.lastTime.IsZero() {
+		span := t.Sub(e.lastTime)
+		if span > e.maxGap {
+			e.resync = true
+		} else if span > 0 {
+			e.energy += float64(e.lastPower+power) / 2 * span.Hours()
+		}
+	}
+	e.lastTime = t
+	e.lastPower = power
+}
+
+/* Pause the integration, e.g. while the inverter is sleeping. */
+func (e *EnergyIntegrator) Pause(day string) {
+	e.switchDay(day)
+	if !e.lastTime.IsZero() {
+		e.lastTime = time.Time{}
+		e.resync = true
+	}
+}
+
+/*
+Reconcile the integrated energy with the DayProduction (kWh) of the
+inverter. Returns the energy and its deviation from the counter, both
+in Wh. A deviation beyond 100 Wh and 5% is reported once a day as an
+anomaly of the counter.
+*/
+func (e *EnergyIntegrator) Reconcile(dayProduction float32) (float64, float64) {
+	counter := float64(dayProduction) * 1000
+	if e.resync && e.energy < counter {
+		// Energy produced during the gap is only known to the inverter
+		e.energy = counter
+	}
+	e.resync = false
+
+	deviation := e.energy - counter
+	if !e.warned && math.Abs(deviation) > 100+0.05*counter {
+		diag.Warn(fmt.Sprintf("Day production anomaly: %.1f kWh reported, %.1f kWh measured.",
+			dayProduction, e.energy/1000))
+		e.warned = true
+	}
+	return e.energy, deviation
+}
+
+func (e *EnergyIntegrator) switchDay(day string) {
+	if day == e.day {
+		return
+	}
+	e.day = day
+	e.energy = 0
+	e.lastTime = time.Time{}
+	e.resync = true
+	e.warned = false
+}
+
+/*
+Updates the integrated day energy of the datagram. Only measured
+datagrams are integrated.
+*/
+func (i *Interpreter) integrate(dg *Datagram, measured bool) {
+	day := i.rollover.Today()
+	if measured {
+		i.integrator.Add(day, dg.Timestamp, dg.Power)
+	} else {
+		i.integrator.Pause(day)
+	}
+	energy, deviation := i.integrator.Reconcile(dg.DayProduction)
+	dg.DayEnergy = float32(math.Round(energy))
+	dg.EnergyDeviation = float32(math.Round(deviation))
+}
@@ -13,15 +13,31 @@ import (
 )
 
 type Interpreter struct {
-	inputQueue *reader.Queue
-	lastData   *Datagram
-	lock       *sync.Mutex
-	hasSlept   bool
-	sleeping   bool
-	status     string
-	lastUpdate time.Time
+	inputQueue  *reader.Queue
+	lastData    *Datagram
+	lock        *sync.Mutex
+	hasSlept    bool
+	sleeping    bool
+	status      string
+	lastUpdate  time.Time
+	store       *StateStore
+	lastSaved   time.Time
+	lastStatus  string
+	rollover    *Rollover
+	peakDay     string
+	peakPower   float32
+	lifetime    float32
+	lifetimeAt  time.Time
+	implausible bool
+	integrator  *EnergyIntegrator
+	history     *History
 }
 
+/*
+The values of the inverter and the values derived from them. Note the
+currents are not (yet) decoded from the frame, so without them the DC
+power and efficiency remain empty.
+*/
 type Datagram struct {
 	Power           float32
 	VoltagePV1      float32
@@ -35,39 +51,32 @@ type Datagram struct {
 	OperationHours  float32 `json:",omitempty"`
 	Status          string
 	FaultCode       int
+	CurrentPV1      float32 `json:",omitempty" mqtt:"omitzero"`
+	CurrentPV2      float32 `json:",omitempty" mqtt:"omitzero"`
+	PowerPV1        float32 `json:",omitempty" mqtt:"omitzero"`
+	PowerPV2        float32 `json:",omitempty" mqtt:"omitzero"`
+	PowerDC         float32 `json:",omitempty" mqtt:"omitzero"`
+	Efficiency      float32 `json:",omitempty" mqtt:"omitzero"`
+	SpecificYield   float32 `json:",omitempty" mqtt:"omitzero"`
+	CapacityFactor  float32 `json:",omitempty" mqtt:"omitzero"`
+	PeakPower       float32
+	DayEnergy       float32
+	EnergyDeviation float32 `json:",omitempty"`
+	LifetimeEnergy  float32 `json:",omitempty" mqtt:"omitzero"`
 	Timestamp       time.Time
 }
 
-type ChannelConfig struct {
-	name   string
-	device string
-	unit   string
-	state  string
-	id     string
-}
-
-func HomeAssistantConfig() [13]ChannelConfig {
-	return [...]ChannelConfig{
-		{name: "Power", device: "power", unit: "W", id: "6dbbd634-cfcc-4ecf-b2e8-130708511b24"},
-		{name: "VoltagePV1", device: "voltage", unit: "V", id: "fc65022e-2db6-405d-9900-80f981b42c21"},
-		{name: "VoltagePV2", device: "voltage", unit: "V", id: "6354256e-520f-48d7-a2da-dc307fcfddf5"},
-		{name: "VoltageBus", device: "voltage", unit: "V", id: "a95a0291-4340-4b93-a07b-aa1b17e917a8"},
-		{name: "VoltageGrid", device: "voltage", unit: "V", id: "8ab07337-e58a-473b-b61b-560596c9621c"},
-		{name: "TotalProduction", device: "energy", unit: "kWh", state: "total", id: "496138a6-aba6-4aca-a47d-9b9aa7aa05a4"},
-		{name: "DayProduction", device: "energy", unit: "kWh", state: "total_increasing", id: "14ef721f-8225-44e1-bbc9-ebe603ea1d81"},
-		{name: "Frequency", device: "frequency", unit: "Hz", id: "851bec08-3410-4227-8e84-5cbcb176329a"},
-		{name: "Temperature", device: "temperature", unit: "°C", id: "490abec4-b9a0-4b34-933b-a1206fa51cc0"},
-		{name: "OperationHours", device: "duration", unit: "h", state: "total", id: "5d82c4fd-8fb6-4465-a402-fcde57ac464f"},
-		{name: "Status", id: "edcd66f5-dc8a-442b-b1f1-fd599dbbf4b0"},
-		{name: "FaultCode", id: "5695793e-8dfb-4a8e-89d6-7bfb9cf99cd8"},
-		{name: "Timestamp", device: "timestamp", id: "21b5c51c-2e87-4b57-a999-a4025e033bf2"}}
-}
-
-func NewInterpreter(inque *reader.Queue) *Interpreter {
+func NewInterpreter(inque *reader.Queue, store *StateStore, rollover *Rollover, history *History) *Interpreter {
 	i := new(Interpreter)
 	i.inputQueue = inque
 	i.lock = &sync.Mutex{}
 	i.hasSlept = false
+	i.store = store
+	i.rollover = rollover
+	i.history = history
+	i.integrator = NewEnergyIntegrator(5 * time.Minute)
+	i.rollover.OnDayClosed(func(DayClosed) { go i.persist(true) })
+	i.restore()
 	return i
 }
 
@@ -86,6 +95,8 @@ received within several seconds.
 */
 func (i *Interpreter) start() {
 	diag.Info("Start interpreter...")
+	go i.watchRollover()
+
 	buffer := make([]byte, 40)
 	idx := 0
 	errCount := 0
@@ -132,6 +143,7 @@ func (i *Interpreter) start() {
 			} else if idx >= 40 {
 				i.status = "Receiving wrong data"
 				i.updateToDatagram("Invalid")
+				diag.InvalidFrames.Add(1)
 
 				diag.Verbose(hex.Dump(buffer[0:idx]))
 
@@ -140,6 +152,7 @@ func (i *Interpreter) start() {
 				if errCount > 20 {
 					diag.Warn("Invalid data received. Waiting...")
 					i.status = "Awaiting correct data"
+					diag.Resyncs.Add(1)
 					time.Sleep(5 * time.Minute)
 					i.inputQueue.Clear()
 					errCount = 0
@@ -156,27 +169,52 @@ func (i *Interpreter) start() {
 }
 
 func (i *Interpreter) updateToDatagram(status string) {
+	// Observe outside the lock, as the listeners of a closed day may use it
+	dayProduction := i.rollover.Observe(time.Now(), 0, false)
+
 	// Update to an empty datagram with updated time
 	i.lock.Lock()
 	// But keep the accumulated data
-	var day float32
 	var total float32
 	var hours float32
 	if i.lastData != nil {
-		day = i.lastData.DayProduction
 		total = i.lastData.TotalProduction
 		hours = i.lastData.OperationHours
 	}
 	i.lastData = NewDatagram()
 	i.lastData.TotalProduction = total
 	i.lastData.OperationHours = hours
-	i.lastData.DayProduction = 0
+	i.lastData.DayProduction = dayProduction
 	i.lastData.Status = status
+	i.integrate(i.lastData, false)
+	i.derive(i.lastData)
+	i.lock.Unlock()
 
-	if i.lastUpdate.Day() == time.Now().Day() {
-		i.lastData.DayProduction = day
+	i.persist(false)
+}
+
+/*
+Checks for a new day while no data is received (e.g. at midnight), so
+the day production is reset in time.
+*/
+func (i *Interpreter) watchRollover() {
+	for {
+		time.Sleep(10 * time.Second)
+		day := i.rollover.Today()
+		if dayOf(i.rollover.Now()) == day {
+			continue
+		}
+		value := i.rollover.Observe(time.Now(), 0, false)
+		i.lock.Lock()
+		if i.lastData != nil {
+			dg := *i.lastData
+			dg.DayProduction = value
+			i.integrate(&dg, false)
+			i.derive(&dg)
+			i.lastData = &dg
+		}
+		i.lock.Unlock()
 	}
-	i.lock.Unlock()
 }
 
 /*
@@ -187,9 +225,12 @@ func (i *Interpreter) createAndStoreDatagram(data []byte) {
 	if len(data) != 30 {
 		diag.Warn("Datagram incorrect size; ignoring " + strconv.Itoa(len(data)) + " bytes ...")
 		diag.Verbose(hex.Dump(data))
+		diag.InvalidFrames.Add(1)
 		return
 	}
 
+	diag.FramesDecoded.Add(1)
+	diag.LastDatagram.Store(time.Now().Unix())
 	dg := new(Datagram)
 	dg.VoltagePV1 = i.decodeValue(data[0], data[1], 10)
 	dg.VoltageBus = i.decodeValue(data[2], data[3], 10)
@@ -203,6 +244,7 @@ func (i *Interpreter) createAndStoreDatagram(data []byte) {
 	dg.OperationHours = i.decodeLargeValue(data[26:30], 7200)
 	dg.FaultCode = i.decodeSmallValue(data[15])
 	dg.Timestamp = time.Now()
+	dg.DayProduction = i.rollover.Observe(dg.Timestamp, dg.DayProduction, true)
 
 	status := i.decodeSmallValue(data[14])
 	switch status {
@@ -216,8 +258,93 @@ func (i *Interpreter) createAndStoreDatagram(data []byte) {
 	}
 
 	i.lock.Lock()
+	i.integrate(dg, true)
+	i.derive(dg)
 	i.lastData = dg
 	i.lock.Unlock()
+
+	if i.history != nil {
+		i.history.Add(dg)
+	}
+
+	i.persist(false)
+}
+
+/*
+Restore the counters from the state store, so a restart (e.g. at
+night) does not report zero production. The day production is only
+restored if it was saved today.
+*/
+func (i *Interpreter) restore() {
+	if i.store == nil {
+		return
+	}
+	state := i.store.Load()
+	if state == nil {
+		return
+	}
+
+	dg := NewDatagram()
+	dg.Status = "Restored"
+	dg.TotalProduction = state.TotalProduction
+	dg.OperationHours = state.OperationHours
+	i.lifetime = max(state.LifetimeEnergy, state.TotalProduction)
+	i.lifetimeAt = state.LastUpdate
+	dg.LifetimeEnergy = i.lifetime
+	i.rollover.Restore(state.Day, state.DayProduction)
+	if state.Day == dayOf(i.rollover.Now()) {
+		dg.DayProduction = state.DayProduction
+		i.peakDay = state.Day
+		i.peakPower = state.PeakPower
+		dg.PeakPower = state.PeakPower
+		dg.DayEnergy = state.DayEnergy
+		i.integrator.Restore(state.Day, float64(state.DayEnergy))
+	}
+	i.lastData = dg
+	i.lastUpdate = state.LastUpdate
+	i.lastStatus = state.Lifecycle
+	diag.Info(fmt.Sprintf("Restored state of %s (%.1f kWh today, %.1f kWh total).",
+		state.Saved.Format("2006-01-02 15:04:05"), dg.DayProduction, dg.TotalProduction))
+}
+
+/*
+Persist the current state. To spare the storage (e.g. an SD card) this
+is done once a minute, unless the status changed or it is forced.
+*/
+func (i *Interpreter) persist(force bool) {
+	if i.store == nil {
+		return
+	}
+
+	i.lock.Lock()
+	if i.lastData == nil {
+		i.lock.Unlock()
+		return
+	}
+	changed := i.lastData.Status != i.lastStatus
+	if !force && !changed && time.Since(i.lastSaved) < time.Minute {
+		i.lock.Unlock()
+		return
+	}
+	dg := *i.lastData
+	state := &State{
+		Day:             i.rollover.Today(),
+		DayProduction:   dg.DayProduction,
+		TotalProduction: dg.TotalProduction,
+		OperationHours:  dg.OperationHours,
+		PeakPower:       i.peakPower,
+		DayEnergy:       dg.DayEnergy,
+		LifetimeEnergy:  i.lifetime,
+		Lifecycle:       dg.Status,
+		LastUpdate:      i.lastUpdate,
+	}
+	i.lastSaved = time.Now()
+	i.lastStatus = dg.Status
+	i.lock.Unlock()
+
+	if err := i.store.Save(state); err != nil {
+		diag.Warn("Could not save state: " + err.Error())
+	}
 }
 
 /* Retrieves the latest datagram as interpreted. */
@@ -6,7 +6,10 @@ import (
 	"fmt"
 
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 
 	"growattrr/diag"
 	"growattrr/reader"
@@ -23,6 +26,60 @@ var delay int
 var user string
 var credential string
 var precision int
+var datadir string
+var timezone string
+var arraySize float64
+var retentionRaw int
+var retention1m int
+var retention15m int
+var retentionDaily int
+var logFormat string
+var logDir string
+var logColumns string
+var logMaxMB int
+var logInterval int
+var inverter string
+var site string
+var influxURL string
+var influxVersion int
+var influxDatabase string
+var influxUser string
+var influxPassword string
+var influxOrg string
+var influxBucket string
+var influxToken string
+var influxMeasurement string
+var influxBatch int
+var influxInterval int
+var pvOutputKey string
+var pvOutputSystem string
+var pvOutputInterval int
+var pvOutputURL string
+var webhookURL string
+var webhookBody string
+var webhookHeaders []string
+var webhookEvents string
+var webhookInterval int
+var webhookTimeout int
+var webhookRetries int
+var mqttClientID string
+var mqttCleanSession bool
+var mqttKeepAlive int
+var mqttConnectTimeout int
+var mqttQos string
+var mqttRetain string
+var mqttVersion int
+var passwordFile string
+var mqttCA string
+var mqttCert string
+var mqttKey string
+var mqttInsecure bool
+var mqttMode string
+var mqttTopicTemplate string
+var mqttCommands bool
+var mqttDeadband string
+var mqttDecimals string
+var mqttHeartbeat string
 
 func init() {
 	flag.StringVar(&action, "action", "Start", "The action (Start or Init).")
@@ -31,11 +88,68 @@ func init() {
 	flag.StringVar(&topic, "topic", "Growatt", "MQTT topic /solar/<topic>/<item>.")
 	flag.StringVar(&user, "user", "", "MQTT user (leave empty to use unauthorized).")
 	flag.StringVar(&credential, "password", "", "MQTT password.")
+	flag.StringVar(&passwordFile, "password-file", "", "File with the MQTT password (or set GROWATT_MQTT_PASSWORD).")
+	flag.StringVar(&mqttCA, "mqtt-ca", "", "CA bundle (PEM) to verify the MQTT broker (ssl://, mqtts:// or wss://).")
+	flag.StringVar(&mqttCert, "mqtt-cert", "", "Client certificate (PEM) for the MQTT broker.")
+	flag.StringVar(&mqttKey, "mqtt-key", "", "Key (PEM) of the client certificate.")
+	flag.BoolVar(&mqttInsecure, "mqtt-insecure", false, "Do not verify the certificate of the MQTT broker (for testing only).")
+	flag.StringVar(&mqttTopicTemplate, "mqtt-topic-template", "/solar/{topic}/{field}", "MQTT topic with {topic}, {inverter}, {site}, {field} and {unit}.")
+	flag.BoolVar(&mqttCommands, "mqtt-commands", false, "Accept commands on the MQTT command topic.")
+	flag.StringVar(&mqttDeadband, "mqtt-deadband", "", "Minimum change to publish a field, absolute or in % (e.g. Power=5,Temperature=2%).")
+	flag.StringVar(&mqttDecimals, "mqtt-decimals", "", "Decimals to publish a field with (e.g. Power=0; default 1, Frequency 2).")
+	flag.StringVar(&mqttHeartbeat, "mqtt-heartbeat", "", "Period (seconds) to publish a field even if unchanged (e.g. 300 or Power=60).")
+	flag.StringVar(&mqttMode, "mqtt-mode", "fields", "Publish a topic per field (fields), the datagram as JSON on the state topic (state) or both.")
+	flag.StringVar(&mqttClientID, "mqtt-client-id", "", "MQTT client ID (default growatt-<host>-<inverter>).")
+	flag.BoolVar(&mqttCleanSession, "mqtt-clean-session", false, "Start a clean MQTT session (drops the session kept by the broker).")
+	flag.IntVar(&mqttKeepAlive, "mqtt-keepalive", 30, "MQTT keepalive (seconds).")
+	flag.IntVar(&mqttConnectTimeout, "mqtt-connect-timeout", 30, "Timeout (seconds) to connect to the MQTT broker.")
+	flag.StringVar(&mqttQos, "mqtt-qos", "values=0,state=0,diagnostics=0", "MQTT QoS for all topics (e.g. 1) or per topic (e.g. values=0,discovery=1); topics not given use 1.")
+	flag.StringVar(&mqttRetain, "mqtt-retain", "status,availability,discovery,reports", "Comma separated MQTT topics to retain (values, status, state, diagnostics, availability, discovery, reports, response).")
+	flag.IntVar(&mqttVersion, "mqtt-version", 0, "MQTT protocol version (3 for 3.1, 4 for 3.1.1, 5 for MQTT 5, 0 for MQTT 5 if the broker offers it, otherwise 3.1.1 or 3.1).")
 	flag.IntVar(&speed, "baudrate", 9600, "The baud rate of the serial connection.")
 	flag.IntVar(&port, "server", 5701, "The server port for the REST service.")
 	flag.IntVar(&delay, "delay", 0, "Period (seconds) of delay to publish values on MQTT.")
 	flag.BoolVar(&verbose, "v", false, "Activate verbose logging.")
-	flag.IntVar(&precision, "precision", -1, "Number of decimals for rounding")
+	flag.IntVar(&precision, "precision", -1, "Default number of decimals of the values on MQTT (instead of 1; -mqtt-decimals takes precedence).")
+	flag.StringVar(&timezone, "timezone", "Local", "Time zone of the production day (e.g. Europe/Amsterdam).")
+	flag.Float64Var(&arraySize, "kwp", 0, "Size of the PV array (kWp) for specific yield and capacity factor.")
+	flag.StringVar(&datadir, "datadir", "", "Directory for persistent data, e.g. /var/lib/growatt (empty to disable).")
+	flag.IntVar(&retentionRaw, "retention-raw", 2, "Days to keep all datagrams in the history (0 is forever).")
+	flag.IntVar(&retention1m, "retention-1m", 31, "Days to keep the 1 minute aggregates in the history (0 is forever).")
+	flag.IntVar(&retention15m, "retention-15m", 400, "Days to keep the 15 minute aggregates in the history (0 is forever).")
+	flag.IntVar(&retentionDaily, "retention-daily", 0, "Days to keep the daily aggregates in the history (0 is forever).")
+	flag.StringVar(&logFormat, "log-format", "", "Log datagrams to daily files as csv or jsonl (empty to disable).")
+	flag.StringVar(&logDir, "log-dir", "", "Directory for the datagram log files (default <datadir>/log).")
+	flag.StringVar(&logColumns, "log-columns", "", "Comma separated fields to log (default all).")
+	flag.IntVar(&logInterval, "log-interval", 0, "Period (seconds) of delay to log datagrams to files.")
+	flag.IntVar(&logMaxMB, "log-max-mb", 100, "Maximum disk usage (MB) of the datagram log files (0 is unlimited).")
+	flag.StringVar(&inverter, "inverter", "", "Name of the inverter (default the MQTT topic).")
+	flag.StringVar(&site, "site", "", "Name of the site of the inverter.")
+	flag.StringVar(&influxURL, "influx-url", "", "Write to InfluxDB (e.g. http://localhost:8086).")
+	flag.IntVar(&influxVersion, "influx-version", 2, "Version of the InfluxDB HTTP API (1 or 2).")
+	flag.StringVar(&influxDatabase, "influx-db", "growatt", "InfluxDB v1 database.")
+	flag.StringVar(&influxUser, "influx-user", "", "InfluxDB v1 user.")
+	flag.StringVar(&influxPassword, "influx-password", "", "InfluxDB v1 password.")
+	flag.StringVar(&influxOrg, "influx-org", "", "InfluxDB v2 organization.")
+	flag.StringVar(&influxBucket, "influx-bucket", "growatt", "InfluxDB v2 bucket.")
+	flag.StringVar(&influxToken, "influx-token", "", "InfluxDB v2 API token.")
+	flag.StringVar(&influxMeasurement, "influx-measurement", "growatt", "InfluxDB measurement.")
+	flag.IntVar(&influxBatch, "influx-batch", 10, "Number of datagrams per InfluxDB write.")
+	flag.IntVar(&influxInterval, "influx-interval", 10, "Period (seconds) of delay to write datagrams to InfluxDB.")
+	flag.StringVar(&pvOutputKey, "pvoutput-key", "", "PVOutput API key.")
+	flag.StringVar(&pvOutputSystem, "pvoutput-system", "", "PVOutput system ID.")
+	flag.IntVar(&pvOutputInterval, "pvoutput-interval", 5, "Status interval (minutes) of the PVOutput system (5, 10 or 15).")
+	flag.StringVar(&pvOutputURL, "pvoutput-url", "https://pvoutput.org/service/r2", "PVOutput service URL.")
+	flag.StringVar(&webhookURL, "webhook-url", "", "Post events to this URL (template, e.g. http://localhost:1880/growatt).")
+	flag.StringVar(&webhookBody, "webhook-body", "{{json .}}", "Template of the webhook body (or @file).")
+	flag.Func("webhook-header", "Webhook header 'Name: value' (template, repeatable).", func(header string) error {
+		webhookHeaders = append(webhookHeaders, header)
+		return nil
+	})
+	flag.StringVar(&webhookEvents, "webhook-events", "datagram,status", "Comma separated events to post (datagram, status).")
+	flag.IntVar(&webhookInterval, "webhook-interval", 60, "Period (seconds) of delay to post datagrams to the webhook.")
+	flag.IntVar(&webhookTimeout, "webhook-timeout", 10, "Timeout (seconds) of a webhook request.")
+	flag.IntVar(&webhookRetries, "webhook-retries", 3, "Number of retries of a failed webhook request.")
 }
 
 var Version = "v1.60"
@@ -46,7 +160,7 @@ func main() {
 	//	Read the command line arguments
 	flag.Parse()
 
-	diag.Verbosive = verbose
+	diag.Verbosive.Store(verbose)
 
 	// Initialize the reader
 	serialReader := reader.NewReader(device, speed)
@@ -69,11 +183,10 @@ func main() {
 
 func actionInit(reader *reader.Reader) {
 	diag.Info("Init requested...")
-	status := reader.InitLogger()
-	if status {
-		diag.Info("Sent. Please restart!")
+	if err := reader.InitLogger(); err != nil {
+		diag.Warn("Failed (" + err.Error() + "). Please retry!")
 	} else {
-		diag.Warn("Failed. Please retry!")
+		diag.Info("Sent. Please restart!")
 	}
 }
 
@@ -82,8 +195,12 @@ func actionStart(reader *reader.Reader) {
 	// Initialize the interpreter and publisher and start all threads to
 	// read data, interpret to datagrams and publish as json
 
-	interpreter := NewInterpreter(reader.GetQueue())
-	publisher := NewPublisher(delay)
+	rollover := NewRollover(timezone)
+	history := NewHistory(dataPath("history"), rollover)
+	interpreter := NewInterpreter(reader.GetQueue(), NewStateStore(dataPath("state.json")), rollover, history)
+	publisher := NewPublisher(history, rollover)
+
+	go awaitShutdown(interpreter, history, publisher)
 
 	go reader.StartMonitored()
 	go interpreter.start()
@@ -91,3 +208,39 @@ func actionStart(reader *reader.Reader) {
 
 	publisher.listen(interpreter, reader)
 }
+
+/*
+Save the state on termination (e.g. by systemd), so no counters are lost.
+*/
+func awaitShutdown(interpreter *Interpreter, history *History, publisher *Publisher) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	diag.Info("Stopping on " + sig.String() + "...")
+	interpreter.persist(true)
+	if history != nil {
+		history.Close()
+	}
+	publisher.Close()
+	os.Exit(0)
+}
+
+/*
+Name of the inverter, which defaults to the MQTT topic.
+*/
+func inverterName() string {
+	if inverter == "" {
+		return topic
+	}
+	return inverter
+}
+
+/*
+Path of a file in the data directory. Empty if persistence is disabled.
+*/
+func dataPath(name string) string {
+	if datadir == "" {
+		return ""
+	}
+	return filepath.Join(datadir, name)
+}
@@ -0,0 +1,122 @@
+// metrics
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"growattrr/diag"
+)
+
+/* Fields of the datagram which only increase. */
+var counterFields = map[string]bool{
+	"TotalProduction": true,
+	"OperationHours":  true,
+	"LifetimeEnergy":  true,
+}
+
+/*
+Expose the datagram and the internal counters in the OpenMetrics format
+(e.g. for Prometheus), e.g. growatt_power{inverter="Growatt"} 798.4
+*/
+func (p *Publisher) getMetrics(w http.ResponseWriter, r *http.Request) {
+	var out strings.Builder
+	labels := "inverter=\"" + escapeLabel(inverterName()) + "\""
+	if site != "" {
+		labels += ",site=\"" + escapeLabel(site) + "\""
+	}
+
+	gauge := func(name string, help string, value float64) {
+		fmt.Fprintf(&out, "# TYPE growatt_%s gauge\n# HELP growatt_%s %s\ngrowatt_%s{%s} %s\n",
+			name, name, help, name, labels, formatMetric(value))
+	}
+	counter := func(name string, help string, value float64) {
+		fmt.Fprintf(&out, "# TYPE growatt_%s counter\n# HELP growatt_%s %s\ngrowatt_%s_total{%s} %s\n",
+			name, name, help, name, labels, formatMetric(value))
+	}
+
+	data, _ := p.snapshot()
+	fields := reflect.TypeOf(*data)
+	values := reflect.ValueOf(*data)
+	for i := range fields.NumField() {
+		field := fields.Field(i)
+		name := snakeCase(field.Name)
+		value := values.Field(i)
+		switch value.Kind() {
+		case reflect.Float32:
+			if value.Float() == 0 && field.Tag.Get("mqtt") == "omitzero" {
+				continue
+			}
+			// Avoid the float32 noise in the output (e.g. 798.4000244140625)
+			number, _ := strconv.ParseFloat(strconv.FormatFloat(value.Float(), 'f', -1, 32), 64)
+			if counterFields[field.Name] {
+				counter(name, field.Name+" of the inverter.", number)
+			} else {
+				gauge(name, field.Name+" of the inverter.", number)
+			}
+		case reflect.Int:
+			gauge(name, field.Name+" of the inverter.", float64(value.Int()))
+		case reflect.String:
+			fmt.Fprintf(&out, "# TYPE growatt_%s stateset\n# HELP growatt_%s %s of the inverter.\n",
+				name, name, field.Name)
+			fmt.Fprintf(&out, "growatt_%s{%s,growatt_%s=\"%s\"} 1\n",
+				name, labels, name, escapeLabel(value.String()))
+		default:
+			timeValue, _ := value.Interface().(time.Time)
+			gauge(name+"_seconds", "Time of the datagram.", float64(timeValue.Unix()))
+		}
+	}
+
+	counter("bytes_read", "Bytes read from the serial port.", float64(diag.BytesRead.Load()))
+	counter("frames_decoded", "Frames decoded to a datagram.", float64(diag.FramesDecoded.Load()))
+	counter("invalid_frames", "Invalid frames received.", float64(diag.InvalidFrames.Load()))
+	counter("resyncs", "Waits for correct data after invalid frames.", float64(diag.Resyncs.Load()))
+	counter("queue_overflows", "Overflows of the read queue.", float64(diag.QueueOverflows.Load()))
+	counter("reconnects", "Reconnects of the serial reader.", float64(diag.Reconnects.Load()))
+	counter("init_attempts", "Attempts to initialize the inverter.", float64(diag.InitAttempts.Load()))
+	counter("init_failures", "Failures to initialize the inverter.", float64(diag.InitFailures.Load()))
+	gauge("last_read_timestamp_seconds", "Time of the last successful read.", float64(diag.LastRead.Load()))
+
+	out.WriteString("# TYPE growatt_sink_published counter\n# HELP growatt_sink_published Publications per sink.\n")
+	for _, info := range p.sinkCounters() {
+		fmt.Fprintf(&out, "growatt_sink_published_total{%s,sink=\"%s\"} %d\n", labels, info.Name, info.Published)
+	}
+	out.WriteString("# TYPE growatt_sink_errors counter\n# HELP growatt_sink_errors Publication errors per sink (e.g. MQTT).\n")
+	for _, info := range p.sinkCounters() {
+		fmt.Fprintf(&out, "growatt_sink_errors_total{%s,sink=\"%s\"} %d\n", labels, info.Name, info.Errors)
+	}
+	out.WriteString("# EOF\n")
+
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	_, _ = w.Write([]byte(out.String()))
+}
+
+/* Convert a field name to snake case, e.g. VoltagePV1 to voltage_pv1. */
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var result strings.Builder
+	for i, c := range runes {
+		if i > 0 && unicode.IsUpper(c) {
+			previous := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextLower) {
+				result.WriteRune('_')
+			}
+		}
+		result.WriteRune(unicode.ToLower(c))
+	}
+	return result.String()
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,707 @@
+// mqtt
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"growattrr/diag"
+)
+
+func init() {
+	RegisterSink("mqtt", newMqttSink)
+}
+
+/*
+Publishes each field of the datagram on its own MQTT topic (if changed)
+and/or the whole datagram as JSON on the state topic, and announces the
+fields to Home Assistant. A field is published once it changed beyond
+its deadband or its heartbeat passed. A single client is kept connected;
+it reconnects by itself. While disconnected the values are not queued
+(these would be stale once connected); all values are published again on
+reconnect. The availability topic is "online" while connected and
+"offline" (the last will) once the reader is gone.
+*/
+type MqttSink struct {
+	env             *SinkEnv
+	client          mqttClient
+	units           map[string]string
+	availability    string
+	stateTopic      string
+	dayTopic        string
+	daily           map[string]bool
+	diagnostics     string
+	status          Status
+	diagnosed       time.Time
+	diagnosedStatus Status
+	mode            string
+	topics          map[string]topicOptions
+	fields          *fieldSettings
+	published       map[string]publishedValue
+	stateData       *Datagram
+	stateAt         time.Time
+	resync          atomic.Bool
+	legacyRemoved   atomic.Bool
+}
+
+/*
+QoS and retain flag per kind of topic (see topicKinds). QoS 1 messages
+of the other kinds than the values are queued while disconnected.
+*/
+type topicOptions struct {
+	qos    byte
+	retain bool
+}
+
+var topicKinds = []string{"values", "status", "state", "diagnostics", "availability", "discovery", "reports", "response"}
+
+/* Maximum wait for the broker to acknowledge a publication. */
+const mqttTimeout = 5 * time.Second
+
+func newMqttSink(env *SinkEnv) (Sink, SinkOptions) {
+	if broker == "" {
+		return nil, SinkOptions{}
+	}
+	diag.Info("Using MQTT via " + broker + " on " + mqttTopicTemplate)
+	if user != "" {
+		diag.Info("Authenticated with '" + user + "'.")
+	}
+	if delay > 0 {
+		diag.Info(fmt.Sprintf("Publish once every %d seconds.", delay))
+	}
+
+	m := new(MqttSink)
+	m.env = env
+	m.units = make(map[string]string)
+	m.daily = make(map[string]bool)
+	for _, item := range HomeAssistantConfig() {
+		m.units[item.name] = item.unit
+		m.daily[item.name] = item.daily
+	}
+	if !strings.Contains(mqttTopicTemplate, "{field}") {
+		diag.Warn("The MQTT topic template needs {field}: " + mqttTopicTemplate)
+		return nil, SinkOptions{}
+	}
+	m.availability = m.topicFor("availability")
+	m.stateTopic = m.topicFor("state")
+	m.dayTopic = m.topicFor("day")
+	m.diagnostics = m.topicFor("diagnostics")
+	m.mode = mqttMode
+	if m.mode != "fields" && m.mode != "state" && m.mode != "both" {
+		diag.Warn("Invalid MQTT mode " + m.mode + " (fields, state or both).")
+		return nil, SinkOptions{}
+	}
+	m.published = make(map[string]publishedValue)
+	var err error
+	if m.fields, err = parseFieldSettings(mqttDeadband, mqttDecimals, mqttHeartbeat); err != nil {
+		diag.Warn("Invalid MQTT field settings: " + err.Error())
+		return nil, SinkOptions{}
+	}
+	m.fields.precision.Store(int64(precision))
+	if m.topics, err = parseTopicOptions(mqttQos, mqttRetain); err != nil {
+		diag.Warn("Invalid MQTT topic options: " + err.Error())
+		return nil, SinkOptions{}
+	}
+	if err := m.initMqttConnection(); err != nil {
+		diag.Warn("Invalid MQTT configuration: " + err.Error())
+		return nil, SinkOptions{}
+	}
+	return m, SinkOptions{Interval: time.Duration(delay) * time.Second, Policy: PublishAlways}
+}
+
+func (m *MqttSink) initMqttConnection() error {
+	clientID := mqttClientID
+	if clientID == "" {
+		clientID = defaultClientID()
+	}
+	diag.Info("MQTT client ID " + clientID)
+	if mqttVersion != 0 && (mqttVersion < 3 || mqttVersion > 5) {
+		return fmt.Errorf("invalid MQTT version %d (3, 4, 5 or 0)", mqttVersion)
+	}
+
+	settings := &mqttSettings{
+		broker:       broker,
+		clientID:     clientID,
+		cleanSession: mqttCleanSession,
+		keepAlive:    time.Duration(mqttKeepAlive) * time.Second,
+		timeout:      time.Duration(mqttConnectTimeout) * time.Second,
+		version:      mqttVersion,
+		store:        dataPath("mqtt"),
+		willTopic:    m.availability,
+		willPayload:  "offline",
+		willQos:      m.topics["availability"].qos,
+		willRetain:   m.topics["availability"].retain,
+		onConnect:    m.connected,
+	}
+	if user != "" {
+		password, err := mqttPassword()
+		if err != nil {
+			return err
+		}
+		settings.user = user
+		settings.password = password
+	}
+	if mqttCA != "" || mqttCert != "" || mqttInsecure {
+		config, err := mqttTLSConfig()
+		if err != nil {
+			return err
+		}
+		settings.tls = config
+	}
+	var err error
+	m.client, err = newMqttClient(settings)
+	return err
+}
+
+/*
+The MQTT password from the file (-password-file), the environment
+(GROWATT_MQTT_PASSWORD) or the command line, so it need not be visible
+in the process list.
+*/
+func mqttPassword() (string, error) {
+	if passwordFile != "" {
+		content, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	if password, found := os.LookupEnv("GROWATT_MQTT_PASSWORD"); found {
+		return password, nil
+	}
+	return credential, nil
+}
+
+/*
+The TLS configuration for ssl://, mqtts:// or wss:// brokers: the CA
+bundle (in addition to the system CAs), the client certificate and key
+for mutual authentication and optionally no verification (for tests).
+*/
+func mqttTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: mqttInsecure}
+	if mqttInsecure {
+		diag.Warn("The certificate of the MQTT broker is not verified!")
+	}
+	if mqttCA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		content, err := os.ReadFile(mqttCA)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates in %s", mqttCA)
+		}
+		config.RootCAs = pool
+	}
+	if mqttCert != "" {
+		certificate, err := tls.LoadX509KeyPair(mqttCert, mqttKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+/*
+Connect to the broker in the background, announce the fields to Home
+Assistant and publish the reports of each closed day.
+*/
+func (m *MqttSink) Init() error {
+	if m.env.History != nil {
+		m.env.Rollover.OnDayClosed(func(closed DayClosed) { go m.publishReports(closed) })
+	}
+	m.client.Connect()
+	return nil
+}
+
+/* Announce the availability and the fields on each (re)connect. */
+func (m *MqttSink) connected() {
+	diag.Info("MQTT connected to " + broker)
+	m.resync.Store(true)
+	m.publish("availability", m.availability, []byte("online"))
+	m.subscribeHomeAssist()
+	if mqttCommands {
+		m.client.Subscribe(m.topicFor("command"), 1, m.command)
+	}
+	if err := m.discoveryHomeAssist(); err != nil {
+		diag.Warn("Discovery for Home Assistant failed: " + err.Error())
+	}
+}
+
+/* Change the default decimals of the values (set_precision). */
+func (m *MqttSink) SetPrecision(decimals int) {
+	m.fields.precision.Store(int64(decimals))
+}
+
+/*
+Pass a command to the publisher and publish the acknowledgement on the
+response topic. Republish announces the fields to Home Assistant again.
+Retained commands are ignored, so these are not executed again on each
+(re)connect.
+*/
+func (m *MqttSink) command(message *mqttMessage) {
+	if message.Retained {
+		diag.Warn("Ignoring retained command on " + message.Topic)
+		return
+	}
+	respond := func(command *Command, result string, err error) {
+		response := CommandResponse{Result: "ok", Message: result}
+		if command != nil {
+			response.Command = command.Name
+			response.Value = command.Value
+		}
+		if err != nil {
+			response.Result = "error"
+			response.Message = err.Error()
+		}
+		payload, _ := json.Marshal(response)
+		m.publish("response", m.topicFor("response"), payload)
+	}
+
+	command, err := parseCommand(message.Payload)
+	if err != nil {
+		respond(nil, "", err)
+		return
+	}
+	command.Done = func(result string, err error) { respond(command, result, err) }
+
+	// Do not block the client while waiting for the discovery
+	go func() {
+		if command.Name == "republish" {
+			if err := m.discoveryHomeAssist(); err != nil {
+				respond(command, "", err)
+				return
+			}
+		}
+		select {
+		case m.env.Commands <- command:
+		default:
+			respond(command, "", errors.New("too many commands waiting"))
+		}
+	}()
+}
+
+/* The health of the reader as published on the diagnostics topic. */
+type Diagnostics struct {
+	Reader        string
+	Interpreter   string
+	Publisher     string
+	Init          string
+	InvalidFrames int64
+	Reconnects    int64
+	LastReadAge   int64
+	Communicating bool
+}
+
+/*
+The reader is communicating if it received a valid datagram within this
+period; bytes which do not make up a datagram do not count.
+*/
+const communicatingPeriod = 5 * time.Minute
+
+/* Period to publish the diagnostics if the status does not change. */
+const diagnosticsInterval = time.Minute
+
+/* Publish the diagnostics once the status changed. */
+func (m *MqttSink) PublishStatus(status *Status) error {
+	m.status = *status
+	if m.status.same(&m.diagnosedStatus) {
+		return nil
+	}
+	return m.publishDiagnostics()
+}
+
+/* Publish the status and counters of the reader as JSON (if connected). */
+func (m *MqttSink) publishDiagnostics() error {
+	if !m.client.IsConnected() {
+		return nil
+	}
+	m.diagnosed = time.Now()
+	m.diagnosedStatus = m.status
+	diagnostics := Diagnostics{
+		Reader:        m.status.Reader,
+		Interpreter:   m.status.Interpreter,
+		Publisher:     m.status.Publisher,
+		Init:          m.status.Init,
+		InvalidFrames: diag.InvalidFrames.Load(),
+		Reconnects:    diag.Reconnects.Load(),
+		LastReadAge:   -1,
+	}
+	if lastRead := diag.LastRead.Load(); lastRead > 0 {
+		diagnostics.LastReadAge = int64(time.Since(time.Unix(lastRead, 0)).Seconds())
+	}
+	if lastDatagram := diag.LastDatagram.Load(); lastDatagram > 0 {
+		diagnostics.Communicating = time.Since(time.Unix(lastDatagram, 0)) < communicatingPeriod
+	}
+	payload, err := json.Marshal(diagnostics)
+	if err != nil {
+		return err
+	}
+	return m.publish("diagnostics", m.diagnostics, payload)
+}
+
+/* Announce the reader is going offline and disconnect. */
+func (m *MqttSink) Close() error {
+	if !m.client.IsConnected() {
+		m.client.Disconnect()
+		return nil
+	}
+	err := m.publish("availability", m.availability, []byte("offline"))
+	m.client.Disconnect()
+	return err
+}
+
+/*
+Energy fields which are not published while the datagram is unavailable
+(e.g. after a restart) and, for the counters (true), neither if zero.
+Home Assistant would take the drop to zero as a reset of the meter.
+*/
+var energyFields = map[string]bool{
+	"TotalProduction": true,
+	"LifetimeEnergy":  true,
+	"DayProduction":   false,
+	"DayEnergy":       false,
+}
+
+func suppressEnergy(data *Datagram, field string, value float64) bool {
+	counter, energy := energyFields[field]
+	return energy && (data.Status == "Unavailable" || (counter && value == 0))
+}
+
+/*
+The datagram as JSON for the state topic, with the values rounded to
+their decimals, without the suppressed energy fields and with the start
+of the production day (DayStart) as the last reset of the daily energy.
+*/
+func (m *MqttSink) statePayload(data *Datagram) ([]byte, error) {
+	content, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]any)
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, err
+	}
+	for field := range energyFields {
+		if value, ok := state[field].(float64); ok && suppressEnergy(data, field, value) {
+			delete(state, field)
+		}
+	}
+	fields := reflect.TypeOf(*data)
+	for i := range fields.NumField() {
+		name := fields.Field(i).Name
+		if value, ok := state[name].(float64); ok && fields.Field(i).Type.Kind() == reflect.Float32 {
+			_, text := m.fields.round(name, value)
+			state[name] = json.RawMessage(text)
+		}
+	}
+	state["DayStart"] = m.env.Rollover.StartOfDay(data.Timestamp).Format(time.RFC3339)
+	return json.Marshal(state)
+}
+
+/*
+Whether the state is to be published: a value changed beyond its deadband
+(both rounded to their decimals), another field changed or the heartbeat
+of a field passed since the state was last published.
+*/
+func (m *MqttSink) stateDue(data *Datagram, now time.Time) bool {
+	if m.stateData == nil {
+		return true
+	}
+	fields := reflect.TypeOf(*data)
+	values := reflect.ValueOf(*data)
+	previous := reflect.ValueOf(*m.stateData)
+	for i := range fields.NumField() {
+		field := fields.Field(i)
+		if heartbeat := m.fields.heartbeat(field.Name); heartbeat > 0 && now.Sub(m.stateAt) >= heartbeat {
+			return true
+		}
+		switch field.Type.Kind() {
+		case reflect.Float32:
+			newValue, _ := m.fields.round(field.Name, values.Field(i).Float())
+			oldValue, _ := m.fields.round(field.Name, previous.Field(i).Float())
+			if m.fields.deadband(field.Name).exceeded(oldValue, newValue) {
+				return true
+			}
+		case reflect.Int:
+			if m.fields.intDeadband(field.Name).exceeded(float64(previous.Field(i).Int()), float64(values.Field(i).Int())) {
+				return true
+			}
+		case reflect.String:
+			if values.Field(i).String() != previous.Field(i).String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+The daily energy fields as last published, with the start of the
+production day (DayStart) as their last reset, for the day topic.
+*/
+func (m *MqttSink) dayPayload(data *Datagram) []byte {
+	day := map[string]any{"DayStart": m.env.Rollover.StartOfDay(data.Timestamp).Format(time.RFC3339)}
+	for name, daily := range m.daily {
+		if published, found := m.published[name]; daily && found {
+			day[name] = json.RawMessage(published.text)
+		}
+	}
+	payload, _ := json.Marshal(day)
+	return payload
+}
+
+/*
+Publish the changed fields of the datagram (or all fields if forced)
+*/
+func (m *MqttSink) PublishDatagram(data *Datagram, forced bool) error {
+	err := m.publishMQTT(data, forced)
+	if forced || time.Since(m.diagnosed) >= diagnosticsInterval {
+		err = errors.Join(err, m.publishDiagnostics())
+	}
+	return err
+}
+
+func (m *MqttSink) publishMQTT(data *Datagram, statusUpdated bool) error {
+
+	// Use reflection to handle fields in data type
+	fields := reflect.TypeOf(*data)
+	valuesNew := reflect.ValueOf(*data)
+	num := fields.NumField()
+
+	// Stale values are not queued; all are published once connected again.
+	// Being offline is reported by the availability, not as an error.
+	if !m.client.IsConnected() {
+		return nil
+	}
+	if m.resync.Swap(false) {
+		statusUpdated = true
+	}
+	var errs []error
+	publish := func(kind string, topic string, payload string) {
+		if err := m.publish(kind, topic, []byte(payload)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	now := time.Now()
+	if m.mode != "fields" && (statusUpdated || m.stateDue(data, now)) {
+		payload, err := m.statePayload(data)
+		if err != nil {
+			return err
+		}
+		publish("state", m.stateTopic, string(payload))
+		m.stateData = data
+		m.stateAt = now
+	}
+	if m.mode == "state" {
+		return errors.Join(errs...)
+	}
+
+	dayChanged, changed := false, false
+	publishField := func(kind string, name string, value float64, text string) {
+		publish(kind, m.topicFor(name), text)
+		m.published[name] = publishedValue{value: value, text: text, at: now}
+		dayChanged = dayChanged || m.daily[name]
+		changed = true
+	}
+
+	for i := range num {
+		field := fields.Field(i)
+		elemNew := valuesNew.Field(i)
+
+		// Publish if changed, forced or the heartbeat passed
+		last, known := m.published[field.Name]
+		heartbeat := m.fields.heartbeat(field.Name)
+		due := statusUpdated || !known || (heartbeat > 0 && now.Sub(last.at) >= heartbeat)
+
+		switch field.Type.Kind() {
+		case reflect.Float32:
+			newValue, text := m.fields.round(field.Name, elemNew.Float())
+			if newValue == 0 && field.Tag.Get("mqtt") == "omitzero" {
+				// Derived value which is unknown
+				continue
+			}
+			if suppressEnergy(data, field.Name, newValue) {
+				continue
+			}
+			if due || m.fields.deadband(field.Name).exceeded(last.value, newValue) {
+				publishField("values", field.Name, newValue, text)
+			}
+		case reflect.Int:
+			newValue := float64(elemNew.Int())
+			if due || m.fields.intDeadband(field.Name).exceeded(last.value, newValue) {
+				publishField("values", field.Name, newValue, fmt.Sprintf("%d", elemNew.Int()))
+			}
+		case reflect.String:
+			if due || strings.Compare(elemNew.String(), last.text) != 0 {
+				// Only one is currently 'Status'
+				publishField("status", field.Name, 0, elemNew.String())
+			}
+		default:
+			// elemNew.Type().String() is always time.Time; as it changes
+			// every datagram, it is only published along with other values
+			if due || changed {
+				timeValue, _ := elemNew.Interface().(time.Time)
+				publishField("values", field.Name, 0, timeValue.Format("2006-01-02T15:04:05-07:00"))
+			}
+		}
+	}
+	if dayChanged {
+		publish("values", m.dayTopic, string(m.dayPayload(data)))
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+Publish the reports of a closed day on MQTT (<root>reports/<period>),
+including the month and year reports if these are closed as well.
+*/
+func (m *MqttSink) publishReports(closed DayClosed) {
+	// Give the history time to store the last datagrams
+	time.Sleep(10 * time.Second)
+
+	for _, report := range m.env.History.closedReports(closed) {
+		payload, _ := json.Marshal(report)
+		diag.Info("Publishing " + report.Period + " report of " + report.Key)
+		m.publish("reports", m.topicFor("reports/"+report.Period), payload)
+	}
+}
+
+/* Publish with the QoS and retain flag of the kind of topic. */
+func (m *MqttSink) publish(kind string, topic string, payload []byte) error {
+	options := m.topics[kind]
+	return m.client.Publish(topic, options.qos, options.retain, payload)
+}
+
+/*
+The client ID derived from the host and inverter name, so readers on the
+same broker do not disconnect each other, e.g. growatt-raspberrypi-Growatt.
+*/
+func defaultClientID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	clientID := []rune("growatt-" + host + "-" + inverterName())
+	for i, c := range clientID {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' {
+			clientID[i] = '_'
+		}
+	}
+	return string(clientID)
+}
+
+/*
+Parse the QoS (e.g. "1" or "values=0,discovery=1") and the retained kinds
+of topics (e.g. "status,availability").
+*/
+func parseTopicOptions(qos string, retain string) (map[string]topicOptions, error) {
+	options := make(map[string]topicOptions)
+	for _, kind := range topicKinds {
+		options[kind] = topicOptions{qos: 1}
+	}
+	parseQos := func(value string) (byte, error) {
+		level, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || level < 0 || level > 2 {
+			return 0, fmt.Errorf("invalid QoS %q (0, 1 or 2)", value)
+		}
+		return byte(level), nil
+	}
+
+	for _, item := range strings.Split(qos, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		kind, value, found := strings.Cut(item, "=")
+		if !found {
+			level, err := parseQos(kind)
+			if err != nil {
+				return nil, err
+			}
+			for _, kind := range topicKinds {
+				options[kind] = topicOptions{qos: level}
+			}
+			continue
+		}
+		kind = strings.TrimSpace(kind)
+		if _, known := options[kind]; !known {
+			return nil, fmt.Errorf("unknown topic %q", kind)
+		}
+		level, err := parseQos(value)
+		if err != nil {
+			return nil, err
+		}
+		options[kind] = topicOptions{qos: level}
+	}
+
+	for _, kind := range strings.Split(retain, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+		option, known := options[kind]
+		if !known {
+			return nil, fmt.Errorf("unknown topic %q", kind)
+		}
+		option.retain = true
+		options[kind] = option
+	}
+	return options, nil
+}
+
+/*
+The topic of a field from the topic template, e.g. /solar/{topic}/{field}
+or home/energy/pv/{inverter}/{field}. Levels left empty (e.g. {unit} of a
+field without unit) are removed.
+*/
+func (m *MqttSink) topicFor(field string) string {
+	name := strings.NewReplacer(
+		"{topic}", topic,
+		"{inverter}", topicLevel(inverterName()),
+		"{site}", topicLevel(site),
+		"{field}", field,
+		"{unit}", topicLevel(m.units[field]),
+	).Replace(mqttTopicTemplate)
+
+	levels := strings.Split(name, "/")
+	result := levels[:1]
+	for _, level := range levels[1:] {
+		if level != "" {
+			result = append(result, level)
+		}
+	}
+	return strings.Join(result, "/")
+}
+
+/*
+A value as a single topic level of ASCII letters, digits, - and _, e.g.
+kWh_kWp for kWh/kWp and C for °C.
+*/
+func topicLevel(value string) string {
+	value = strings.NewReplacer("°", "", "%", "percent").Replace(value)
+	var result strings.Builder
+	for _, c := range value {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' {
+			result.WriteRune(c)
+		} else {
+			result.WriteRune('_')
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMqttStatePayloadUnavailable(t *testing.T) {
+	fields, err := parseFieldSettings("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &MqttSink{env: &SinkEnv{Rollover: NewRollover("")}, fields: fields}
+
+	data := &Datagram{Status: "Unavailable", DayProduction: 12.3, DayEnergy: 12300,
+		TotalProduction: 4567.8, LifetimeEnergy: 4567.8, Timestamp: time.Now()}
+	payload, err := sink.statePayload(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := make(map[string]any)
+	if err := json.Unmarshal(payload, &state); err != nil {
+		t.Fatal(err)
+	}
+	for field := range energyFields {
+		if value, ok := state[field]; ok {
+			t.Errorf("%s = %v while unavailable", field, value)
+		}
+	}
+	if state["Status"] != "Unavailable" || state["DayStart"] == nil {
+		t.Errorf("state = %s", payload)
+	}
+}
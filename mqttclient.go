@@ -0,0 +1,463 @@
+// mqttclient
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"growattrr/diag"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/autopaho/queue"
+	"github.com/eclipse/paho.golang/autopaho/queue/file"
+	"github.com/eclipse/paho.golang/autopaho/queue/memory"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+/*
+A connection to the broker with MQTT 3.1/3.1.1 or MQTT 5, as the sink
+uses it. The client reconnects by itself and calls the connect handler on
+each (re)connect. While disconnected, publications with QoS 1 or 2 are
+queued and the others are refused.
+*/
+type mqttClient interface {
+	Connect()
+	IsConnected() bool
+	Publish(topic string, qos byte, retain bool, payload []byte) error
+	Subscribe(topic string, qos byte, handler func(message *mqttMessage))
+	Disconnect()
+}
+
+/* A message received on a subscribed topic. */
+type mqttMessage struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+}
+
+/* The connection settings common to both protocol versions. */
+type mqttSettings struct {
+	broker       string
+	clientID     string
+	cleanSession bool
+	keepAlive    time.Duration
+	timeout      time.Duration
+	version      int
+	user         string
+	password     string
+	tls          *tls.Config
+	store        string
+	willTopic    string
+	willPayload  string
+	willQos      byte
+	willRetain   bool
+	onConnect    func()
+}
+
+var errMqttOffline = errors.New("MQTT not connected")
+
+/*
+The client for the protocol version: MQTT 5 for version 5, 3.1.1 or 3.1
+for versions 4 and 3, and for version 0 MQTT 5 if the broker offers it,
+otherwise the version the MQTT 3 client negotiates.
+*/
+func newMqttClient(settings *mqttSettings) (mqttClient, error) {
+	switch settings.version {
+	case 5:
+		return newMqtt5Client(settings)
+	case 0:
+		return &mqttAutoClient{settings: settings, stop: make(chan struct{})}, nil
+	default:
+		return newMqtt3Client(settings), nil
+	}
+}
+
+/* MQTT 3.1 and 3.1.1 with the Paho MQTT client. */
+type mqtt3Client struct {
+	client mqtt.Client
+}
+
+func newMqtt3Client(settings *mqttSettings) *mqtt3Client {
+	opts := mqtt.NewClientOptions().
+		AddBroker(settings.broker).
+		SetClientID(settings.clientID).
+		SetCleanSession(settings.cleanSession).
+		SetKeepAlive(settings.keepAlive).
+		SetConnectTimeout(settings.timeout).
+		SetProtocolVersion(uint(settings.version)).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10*time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(settings.willTopic, settings.willPayload, settings.willQos, settings.willRetain).
+		SetOnConnectHandler(func(client mqtt.Client) { settings.onConnect() }).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			diag.Warn("MQTT connection lost: " + err.Error())
+		})
+	if settings.user != "" {
+		opts.SetUsername(settings.user)
+		opts.SetPassword(settings.password)
+	}
+	if settings.tls != nil {
+		opts.SetTLSConfig(settings.tls)
+	}
+	if settings.store != "" {
+		// Keep the queued messages over restarts
+		opts.SetStore(mqtt.NewFileStore(settings.store))
+	}
+	return &mqtt3Client{client: mqtt.NewClient(opts)}
+}
+
+func (c *mqtt3Client) Connect() {
+	// Retried until connected; the publications are queued meanwhile
+	c.client.Connect()
+}
+
+func (c *mqtt3Client) IsConnected() bool {
+	return c.client.IsConnectionOpen()
+}
+
+func (c *mqtt3Client) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	if !c.client.IsConnectionOpen() && qos == 0 {
+		return errMqttOffline
+	}
+	token := c.client.Publish(topic, qos, retain, payload)
+	if !c.client.IsConnectionOpen() {
+		// Queued until connected
+		return nil
+	}
+	if !token.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("MQTT publication on %s not acknowledged", topic)
+	}
+	return token.Error()
+}
+
+func (c *mqtt3Client) Subscribe(topic string, qos byte, handler func(message *mqttMessage)) {
+	c.client.Subscribe(topic, qos, func(client mqtt.Client, message mqtt.Message) {
+		handler(&mqttMessage{Topic: message.Topic(), Payload: message.Payload(), Retained: message.Retained()})
+	})
+}
+
+func (c *mqtt3Client) Disconnect() {
+	c.client.Disconnect(250)
+}
+
+/*
+MQTT 5 with the Paho autopaho client. The subscriptions are handled by
+topic; publications while disconnected go to the queue of autopaho,
+which is kept in the data directory.
+*/
+type mqtt5Client struct {
+	config    autopaho.ClientConfig
+	manager   *autopaho.ConnectionManager
+	connected atomic.Bool
+	lock      sync.Mutex
+	handlers  map[string]func(message *mqttMessage)
+}
+
+func newMqtt5Client(settings *mqttSettings) (*mqtt5Client, error) {
+	server, err := url.Parse(settings.broker)
+	if err != nil {
+		return nil, err
+	}
+	c := &mqtt5Client{handlers: make(map[string]func(message *mqttMessage))}
+
+	var messages queue.Queue = memory.New()
+	if settings.store != "" {
+		// Keep the queued messages over restarts, apart from the MQTT 3 store
+		store := settings.store + "5"
+		if err := os.MkdirAll(store, 0755); err != nil {
+			return nil, err
+		}
+		if messages, err = file.New(store, "queue", ".msg"); err != nil {
+			return nil, err
+		}
+	}
+	var expiry uint32
+	if !settings.cleanSession {
+		expiry = 0xFFFFFFFF
+	}
+
+	c.config = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{server},
+		TlsCfg:                        settings.tls,
+		KeepAlive:                     uint16(settings.keepAlive.Seconds()),
+		CleanStartOnInitialConnection: settings.cleanSession,
+		SessionExpiryInterval:         expiry,
+		ReconnectBackoff:              mqttBackoff,
+		ConnectTimeout:                settings.timeout,
+		Queue:                         messages,
+		WillMessage: &paho.WillMessage{
+			Topic:   settings.willTopic,
+			Payload: []byte(settings.willPayload),
+			QoS:     settings.willQos,
+			Retain:  settings.willRetain,
+		},
+		OnConnectionUp: func(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+			// Called before NewConnection may have returned
+			c.lock.Lock()
+			c.manager = manager
+			c.lock.Unlock()
+			c.connected.Store(true)
+			go settings.onConnect()
+		},
+		OnConnectError: func(err error) {
+			diag.Warn("MQTT connection failed: " + err.Error())
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          settings.clientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.received},
+			OnClientError: func(err error) {
+				c.connected.Store(false)
+				diag.Warn("MQTT connection lost: " + err.Error())
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				c.connected.Store(false)
+				diag.Warn(fmt.Sprintf("MQTT connection closed by the broker (reason %d)", disconnect.ReasonCode))
+			},
+		},
+	}
+	if settings.user != "" {
+		c.config.ConnectUsername = settings.user
+		c.config.ConnectPassword = []byte(settings.password)
+	}
+	return c, nil
+}
+
+/* Reconnect at once, then after 10 seconds doubling up to a minute. */
+func mqttBackoff(attempt int) time.Duration {
+	if attempt == 0 {
+		return 0
+	}
+	return min(10*time.Second<<min(attempt-1, 3), time.Minute)
+}
+
+func (c *mqtt5Client) Connect() {
+	manager, err := autopaho.NewConnection(context.Background(), c.config)
+	if err != nil {
+		diag.Warn("MQTT connection failed: " + err.Error())
+		return
+	}
+	c.lock.Lock()
+	c.manager = manager
+	c.lock.Unlock()
+}
+
+func (c *mqtt5Client) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *mqtt5Client) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	c.lock.Lock()
+	manager := c.manager
+	c.lock.Unlock()
+	if manager == nil {
+		return errMqttOffline
+	}
+	publication := &paho.Publish{Topic: topic, QoS: qos, Retain: retain, Payload: payload}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+	defer cancel()
+	if c.connected.Load() {
+		_, err := manager.Publish(ctx, publication)
+		if !errors.Is(err, autopaho.ConnectionDownError) {
+			return err
+		}
+	}
+	if qos == 0 {
+		return errMqttOffline
+	}
+	return manager.PublishViaQueue(ctx, &autopaho.QueuePublish{Publish: publication})
+}
+
+func (c *mqtt5Client) Subscribe(topic string, qos byte, handler func(message *mqttMessage)) {
+	c.lock.Lock()
+	c.handlers[topic] = handler
+	manager := c.manager
+	c.lock.Unlock()
+	if manager == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqttTimeout)
+	defer cancel()
+	subscription := &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}}}
+	if _, err := manager.Subscribe(ctx, subscription); err != nil {
+		diag.Warn("MQTT subscription to " + topic + " failed: " + err.Error())
+	}
+}
+
+/* Pass a received message to the handler of its topic. */
+func (c *mqtt5Client) received(publication paho.PublishReceived) (bool, error) {
+	packet := publication.Packet
+	c.lock.Lock()
+	handler, found := c.handlers[packet.Topic]
+	c.lock.Unlock()
+	if found {
+		handler(&mqttMessage{Topic: packet.Topic, Payload: packet.Payload, Retained: packet.Retain})
+	}
+	return found, nil
+}
+
+func (c *mqtt5Client) Disconnect() {
+	c.lock.Lock()
+	manager := c.manager
+	c.lock.Unlock()
+	if manager == nil {
+		return
+	}
+	c.connected.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = manager.Disconnect(ctx)
+}
+
+/*
+Uses MQTT 5 if the broker offers it, otherwise MQTT 3.1.1 or 3.1. The
+broker is asked once, by connecting with MQTT 5 before the actual client
+connects; a broker which does not know MQTT 5 refuses the version or
+drops the connection. Until it is known, publications are refused.
+*/
+type mqttAutoClient struct {
+	settings *mqttSettings
+	lock     sync.Mutex
+	client   mqttClient
+	stop     chan struct{}
+	stopped  bool
+}
+
+func (c *mqttAutoClient) Connect() {
+	go func() {
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-time.After(mqttBackoff(attempt)):
+			case <-c.stop:
+				return
+			}
+			supported, err := probeMqtt5(c.settings)
+			if err != nil {
+				diag.Warn("MQTT connection failed: " + err.Error())
+				continue
+			}
+
+			var client mqttClient = newMqtt3Client(c.settings)
+			if supported {
+				diag.Info("The MQTT broker offers MQTT 5.")
+				if client5, err := newMqtt5Client(c.settings); err != nil {
+					diag.Warn("MQTT 5 not usable, using MQTT 3.1.1: " + err.Error())
+				} else {
+					client = client5
+				}
+			}
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			if !c.stopped {
+				c.client = client
+				client.Connect()
+			}
+			return
+		}
+	}()
+}
+
+func (c *mqttAutoClient) current() mqttClient {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.client
+}
+
+func (c *mqttAutoClient) IsConnected() bool {
+	client := c.current()
+	return client != nil && client.IsConnected()
+}
+
+func (c *mqttAutoClient) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	client := c.current()
+	if client == nil {
+		return errMqttOffline
+	}
+	return client.Publish(topic, qos, retain, payload)
+}
+
+func (c *mqttAutoClient) Subscribe(topic string, qos byte, handler func(message *mqttMessage)) {
+	if client := c.current(); client != nil {
+		client.Subscribe(topic, qos, handler)
+	}
+}
+
+func (c *mqttAutoClient) Disconnect() {
+	c.lock.Lock()
+	client := c.client
+	if !c.stopped {
+		c.stopped = true
+		close(c.stop)
+	}
+	c.lock.Unlock()
+	if client != nil {
+		client.Disconnect()
+	}
+}
+
+/*
+Whether the broker accepts MQTT 5. An error means the broker could not
+be reached (the question stays open). WebSocket brokers are not asked;
+these use MQTT 3.1.1 unless -mqtt-version 5 is given.
+*/
+func probeMqtt5(settings *mqttSettings) (bool, error) {
+	server, err := url.Parse(settings.broker)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), settings.timeout)
+	defer cancel()
+
+	var conn net.Conn
+	switch strings.ToLower(server.Scheme) {
+	case "mqtt", "tcp", "":
+		conn, err = new(net.Dialer).DialContext(ctx, "tcp", server.Host)
+	case "ssl", "tls", "mqtts", "tcps":
+		dialer := &tls.Dialer{Config: settings.tls}
+		conn, err = dialer.DialContext(ctx, "tcp", server.Host)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	client := paho.NewClient(paho.ClientConfig{ClientID: settings.clientID + "-probe", Conn: conn})
+	connect := &paho.Connect{
+		ClientID:     settings.clientID + "-probe",
+		CleanStart:   true,
+		KeepAlive:    uint16(settings.keepAlive.Seconds()),
+		UsernameFlag: settings.user != "",
+		Username:     settings.user,
+		PasswordFlag: settings.user != "",
+		Password:     []byte(settings.password),
+	}
+	connack, err := client.Connect(ctx, connect)
+	switch {
+	case err == nil:
+		_ = client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		return true, nil
+	case connack != nil:
+		// Refused for another reason than the version (e.g. the credentials)
+		return connack.ReasonCode != 0x84 && connack.ReasonCode != 0x01, nil
+	case ctx.Err() != nil:
+		return false, ctx.Err()
+	default:
+		// The broker closed the connection or answered with MQTT 3
+		return false, nil
+	}
+}
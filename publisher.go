@@ -3,21 +3,18 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
-	"math"
 	"net/http"
-	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"growattrr/diag"
 	"growattrr/reader"
 
 	"github.com/gorilla/mux"
-
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 type Status struct {
@@ -25,120 +22,35 @@ type Status struct {
 	Interpreter string
 	Publisher   string
 	Init        string
+	Sinks       []SinkInfo `json:",omitempty"`
 }
 
 type Publisher struct {
-	data   *Datagram // type var for data to be published
+	lock   sync.Mutex // guards data and status for the handlers
+	data   *Datagram  // type var for data to be published
 	status *Status
 
-	prevData   *Datagram
-	prevMqtt   *Datagram
-	nextUpdate time.Time
-	opts       *mqtt.ClientOptions
-	topicRoot  string
-	period     int
-	publishDay int
+	prevData  *Datagram
+	dayClosed atomic.Bool
+	history   *History
+	rollover  *Rollover
+	sinks     []*sinkRunner
+	commands  chan *Command
+	republish bool
 }
 
-func NewPublisher(delay int) *Publisher {
+func NewPublisher(history *History, rollover *Rollover) *Publisher {
 	p := new(Publisher)
+	p.history = history
+	p.rollover = rollover
 	p.status = new(Status)
 	p.data = NewDatagram()
 	p.prevData = p.data
-	p.prevMqtt = p.data
-	p.period = delay
-	p.nextUpdate = time.Now()
-	p.publishDay = time.Now().Day()
-
-	if broker != "" {
-		diag.Info("Using MQTT via " + broker + " on /solar/" + topic)
-		if user != "" {
-			diag.Info("Authenticated with '" + user + "'.")
-		}
-		if p.period > 0 {
-			diag.Info(fmt.Sprintf("Publish once every %d seconds.", p.period))
-		}
-
-		p.topicRoot = "/solar/" + topic + "/"
-		p.initMqttConnection()
-	}
-
+	p.commands = make(chan *Command, 10)
+	p.sinks = createSinks(&SinkEnv{History: history, Rollover: rollover, Commands: p.commands})
 	return p
 }
 
-func (p *Publisher) initMqttConnection() {
-	p.opts = mqtt.NewClientOptions().
-		AddBroker(broker).
-		SetCleanSession(false).
-		SetClientID("Growatt connector")
-
-	if user != "" {
-		p.opts.SetUsername(user)
-		p.opts.SetPassword(credential)
-	}
-}
-
-func Item(name string, value string) string    { return _element(name, "\""+value+"\"", false) }
-func ItemEnd(name string, value string) string { return _element(name, "\""+value+"\"", true) }
-func Object(name string, value string) string  { return _element(name, "{"+value+"}", false) }
-func _element(name string, value string, end bool) string {
-	postfix := ","
-	if end {
-		postfix = ""
-	}
-	return "\"" + name + "\":" + value + postfix
-}
-
-func (p *Publisher) discoveryHomeAssist() {
-	client := mqtt.NewClient(p.opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		diag.Warn("MQTT not available while discovering!")
-		return
-	}
-
-	diag.Warn("Discovery for Home Assistant")
-
-	configArray := HomeAssistantConfig()
-	for i := 0; i < len(configArray); i++ {
-		item := configArray[i]
-		device := Object("device", Item("name", "Growatt Reader")+
-			Item("sw_version", Version)+
-			Item("identifiers", "lemval_growatt_inverter_reader")+
-			ItemEnd("manufacturer", "Growatt"))
-
-		class := ""
-		if item.device != "" {
-			class = Item("device_class", item.device)
-		}
-
-		unit := ""
-		if item.unit != "" {
-			unit = Item("unit_of_measurement", item.unit)
-		}
-		state := ""
-		if item.state != "" {
-			state = Item("state_class", item.state)
-		}
-		payload := "{" +
-			Item("name", item.name) +
-			class +
-			unit +
-			state +
-			device +
-			Item("default_entity_id", topic+"_"+item.name) +
-			Item("unique_id", item.id) +
-			ItemEnd("state_topic", "/solar/"+topic+"/"+item.name) +
-			"}"
-
-		client.Publish(
-			"homeassistant/sensor/"+topic+"/"+item.name+"/config",
-			0, true,
-			payload).Wait()
-	}
-
-	client.Disconnect(250)
-}
-
 /*
 	Start the publisher by opening up an REST endpoint to publish the datagram.
 */
@@ -147,6 +59,16 @@ func (p *Publisher) start(port int) {
 	router := mux.NewRouter()
 	router.HandleFunc("/status", p.getDatagram).Methods("GET")
 	router.HandleFunc("/info", p.getInfo).Methods("GET")
+	router.HandleFunc("/metrics", p.getMetrics).Methods("GET")
+	if p.history != nil {
+		p.routeHistory(router)
+	}
+	for _, sink := range p.sinks {
+		if provider, ok := sink.sink.(RouteProvider); ok {
+			provider.Routes(router)
+		}
+	}
+	p.routeDashboard(router)
 	diag.Info("Starting server on port " + serverPort)
 	log.Fatal(http.ListenAndServe(":"+serverPort, router))
 }
@@ -157,30 +79,35 @@ func (p *Publisher) start(port int) {
 func (p *Publisher) listen(supplier *Interpreter, reader *reader.Reader) {
 
 	var prevStatus string
+	var prevInfo Status
 	var statusUpdated bool
 
-	if p.opts != nil {
-		p.discoveryHomeAssist()
-	}
+	// Publish all values once a production day has been closed
+	p.rollover.OnDayClosed(func(DayClosed) { p.dayClosed.Store(true) })
 
 	for {
+		// Execute the commands (e.g. from MQTT) between publications
+		select {
+		case command := <-p.commands:
+			p.run(command, reader)
+		default:
+		}
+
+		statusUpdated = p.republish
+		p.republish = false
+
+		data := supplier.getDatagram()
+		p.lock.Lock()
 		p.status.Interpreter = supplier.status
 		p.status.Reader = reader.Status
 		p.status.Init = reader.InitStatus
-		statusUpdated = false
-
-		data := supplier.getDatagram()
 		if data != nil {
 			if strings.Compare(prevStatus, data.Status) != 0 {
 				diag.Info("Status updated to " + data.Status + " on " + time.Now().Format("15:04:05"))
 				prevStatus = data.Status
 				statusUpdated = true
 			}
-			day := time.Now().Day()
-			if day != p.publishDay {
-				diag.Warn(fmt.Sprintf("Day updated from %d to %d", p.publishDay, day))
-				p.publishDay = day
-				data.DayProduction = 0
+			if p.dayClosed.Swap(false) {
 				statusUpdated = true
 			}
 			p.status.Publisher = data.Status
@@ -192,120 +119,104 @@ func (p *Publisher) listen(supplier *Interpreter, reader *reader.Reader) {
 			p.prevData = p.data
 			p.data = NewDatagram()
 		}
+		p.lock.Unlock()
 
-		if p.opts != nil {
-			p.publishMQTT(false, statusUpdated)
+		for _, sink := range p.sinks {
+			sink.offer(p.data, statusUpdated)
 		}
 
+		info := p.status.lifecycle()
+		if !info.same(&prevInfo) {
+			prevInfo = info
+			for _, sink := range p.sinks {
+				sink.offerStatus(info)
+			}
+		}
+		counters := p.sinkCounters()
+		p.lock.Lock()
+		p.status.Sinks = counters
+		p.lock.Unlock()
+
 		time.Sleep(500 * time.Millisecond)
 	}
 }
 
 /*
-	Listen to the supplier and keep track of statuses
+The lifecycle of the status as published to the sinks: without the sink
+counters and the times of the last read, and with the transient states
+of reading combined (e.g. Reading and Supplying datagrams are both
+Receiving). It only changes when the state of the reader does.
 */
-func (p *Publisher) publishMQTT(retry bool, statusUpdated bool) {
-
-	if p.data == nil {
-		return
+func (s *Status) lifecycle() Status {
+	return Status{
+		Reader:      lifecycleState(s.Reader),
+		Interpreter: lifecycleState(s.Interpreter),
+		Publisher:   lifecycleState(s.Publisher),
+		Init:        s.Init,
 	}
+}
 
-	if !statusUpdated && p.period > 0 {
-		if time.Now().Before(p.nextUpdate) {
-			// Update later
-			return
-		}
-		p.nextUpdate = time.Now().Add(time.Second * time.Duration(delay))
-	}
+/* Compare the statuses, ignoring the sink counters. */
+func (s *Status) same(other *Status) bool {
+	return s.Reader == other.Reader && s.Interpreter == other.Interpreter &&
+		s.Publisher == other.Publisher && s.Init == other.Init
+}
 
-	client := mqtt.NewClient(p.opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		if !retry {
-			p.initMqttConnection()
-			p.publishMQTT(true, statusUpdated)
-		} else {
-			diag.Warn("Could not publish MQTT message!")
-			return
-		}
+func lifecycleState(state string) string {
+	switch {
+	case strings.HasPrefix(state, "Last read on"):
+		return "Reading"
+	case strings.HasPrefix(state, "Last poll on"), state == "Receiving data",
+		state == "Supplying datagrams", state == "Reading":
+		return "Receiving"
+	case strings.HasPrefix(state, "No datagram on"):
+		return "No datagram"
 	}
+	return state
+}
 
-	// if statusUpdated {
-	// 	diag.Info("Processing for MQTT: " + p.data.String())
-	// 	diag.Info("Previous dataset   : " + p.prevData.String())
-	// }
-
-	// Use reflection to handle fields in data type
-	fields := reflect.TypeOf(*p.data)
-	valuesNew := reflect.ValueOf(*p.data)
-	valuesOld := reflect.ValueOf(*p.prevMqtt)
-	num := fields.NumField()
-
-	const TOLERANCE = 0.00001
-
-	for i := range num {
-		field := fields.Field(i)
-		elemNew := valuesNew.Field(i)
-		elemOld := valuesOld.Field(i)
-
-		switch field.Type.Kind() {
-		case reflect.Float32:
-			oldValue := elemOld.Float()
-			newValue := elemNew.Float()
-			if precision >= 0 {
-				factor := math.Pow10(precision)
-				oldValue = math.Round(oldValue*factor) / factor
-				newValue = math.Round(newValue*factor) / factor
-			}
-			diff := math.Abs(oldValue - newValue)
+/* The counters of all sinks. */
+func (p *Publisher) sinkCounters() []SinkInfo {
+	counters := make([]SinkInfo, 0, len(p.sinks))
+	for _, sink := range p.sinks {
+		counters = append(counters, sink.counters())
+	}
+	return counters
+}
 
-			// if statusUpdated {
-			// 	diag.Info(fmt.Sprintf("On field: %s; publish: %t", field.Name, diff > TOLERANCE))
-			// 	diag.Info(fmt.Sprintf("From    : %f to %f", oldValue, newValue))
-			// }
-			if statusUpdated || diff > TOLERANCE {
-				// diag.Info(fmt.Sprintf("Publishing: %f -> %f to %s", oldValue, newValue, p.topicRoot+field.Name))
-				token := client.Publish(p.topicRoot+field.Name, 0, false, fmt.Sprintf("%.1f", newValue))
-				token.Wait()
-			}
-		case reflect.Int:
-			oldValue := elemOld.Int()
-			newValue := elemNew.Int()
-			// diag.Info(fmt.Sprintf("Int value: %d -> %d (%s)", oldValue, newValue, p.topicRoot+field.Name))
-			if diff := math.Abs(float64(oldValue - newValue)); statusUpdated || diff > TOLERANCE {
-				// diag.Info(fmt.Sprintf("Publishing: %d", newValue))
-				token := client.Publish(p.topicRoot+field.Name, 0, false, fmt.Sprintf("%d", newValue))
-				token.Wait()
-			}
-		case reflect.String:
-			// diag.Info(fmt.Sprintf("String value: %s -> %s (%s)", elemOld.String(), elemNew.String(), p.topicRoot+field.Name))
-			if statusUpdated || strings.Compare(elemNew.String(), elemOld.String()) != 0 {
-				// Only one is currently 'Status' which should be retained
-				token := client.Publish(p.topicRoot+field.Name, 0, true, elemNew.String())
-				token.Wait()
-			}
-		default:
-			// diag.Info(fmt.Sprintf("Other value: %s -> %s (%s)", elemOld.String(), elemNew.String(), p.topicRoot+field.Name))
-			// elemNew.Type().String() is always time.Time
-			timeValue, _ := elemNew.Interface().(time.Time)
-			token := client.Publish(p.topicRoot+field.Name, 0, false, timeValue.Format("2006-01-02T15:04:05-07:00"))
-			token.Wait()
+/*
+	Close all sinks, e.g. on termination.
+*/
+func (p *Publisher) Close() {
+	for _, sink := range p.sinks {
+		if err := sink.close(); err != nil {
+			diag.Warn("Closing sink " + sink.info.Name + " failed: " + err.Error())
 		}
 	}
-	p.prevMqtt = p.data
-
-	client.Disconnect(250)
 }
 
 /*
 	Receive an JSON encoded datagram for publication
 */
 func (p *Publisher) getDatagram(w http.ResponseWriter, r *http.Request) {
-	_ = json.NewEncoder(w).Encode(p.data)
+	data, _ := p.snapshot()
+	_ = json.NewEncoder(w).Encode(data)
 }
 
 /*
 	Receive an JSON encoded datagram for publication
 */
 func (p *Publisher) getInfo(w http.ResponseWriter, r *http.Request) {
-	_ = json.NewEncoder(w).Encode(p.status)
+	_, status := p.snapshot()
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+/*
+	The latest datagram and a copy of the status, as the listen loop
+	replaces these meanwhile.
+*/
+func (p *Publisher) snapshot() (*Datagram, Status) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.data, *p.status
 }
@@ -0,0 +1,354 @@
+// pvoutput
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"growattrr/diag"
+)
+
+func init() {
+	RegisterSink("pvoutput", newPvOutputSink)
+}
+
+/*
+Uploads the production to PVOutput.org once per status interval (5, 10
+or 15 minutes). Intervals missed during an outage are uploaded from the
+history (up to 14 days back, as PVOutput accepts) on a goroutine of its
+own, so the live statuses are not delayed. The rate limit of PVOutput
+(about 60 requests per hour) is respected: requests are postponed until
+the limit is reset, and the backfill leaves some requests for the live
+statuses.
+*/
+type PvOutputSink struct {
+	env          *SinkEnv
+	client       *http.Client
+	interval     time.Duration
+	last         time.Time
+	lastFile     string
+	backfillFile string
+	lock         sync.Mutex
+	retryAt      time.Time
+	remaining    int
+	reset        time.Time
+	gapFrom      time.Time
+	gapTo        time.Time
+	backfilling  bool
+	stop         chan struct{}
+	stopped      chan struct{}
+}
+
+/* Number of statuses per batch request as accepted by PVOutput. */
+const pvOutputBatch = 30
+
+/* Requests per hour left to the live statuses while backfilling. */
+const pvOutputReserve = 12
+
+func newPvOutputSink(env *SinkEnv) (Sink, SinkOptions) {
+	options := SinkOptions{Policy: PublishAlways}
+	if pvOutputKey == "" || pvOutputSystem == "" {
+		return nil, options
+	}
+	if pvOutputInterval != 5 && pvOutputInterval != 10 && pvOutputInterval != 15 {
+		diag.Warn(fmt.Sprintf("Invalid PVOutput interval %d (5, 10 or 15).", pvOutputInterval))
+		return nil, options
+	}
+
+	s := new(PvOutputSink)
+	s.env = env
+	s.client = &http.Client{Timeout: 10 * time.Second}
+	s.interval = time.Duration(pvOutputInterval) * time.Minute
+	s.lastFile = dataPath("pvoutput.last")
+	s.backfillFile = dataPath("pvoutput.backfill")
+	s.remaining = -1
+	s.stop = make(chan struct{})
+	diag.Info(fmt.Sprintf("Uploading to PVOutput system %s every %d minutes.", pvOutputSystem, pvOutputInterval))
+	return s, options
+}
+
+/* Restore the last uploaded interval and the intervals still to backfill. */
+func (s *PvOutputSink) Init() error {
+	if s.lastFile != "" {
+		if content, err := os.ReadFile(s.lastFile); err == nil {
+			if last, err := time.Parse(time.RFC3339, strings.TrimSpace(string(content))); err == nil {
+				s.last = last
+			}
+		}
+	}
+	if s.backfillFile != "" {
+		if content, err := os.ReadFile(s.backfillFile); err == nil {
+			from, to, _ := strings.Cut(strings.TrimSpace(string(content)), " ")
+			first, err1 := time.Parse(time.RFC3339, from)
+			end, err2 := time.Parse(time.RFC3339, to)
+			if err1 == nil && err2 == nil {
+				s.gapFrom, s.gapTo = first, end
+			}
+		}
+	}
+	return nil
+}
+
+func (s *PvOutputSink) PublishStatus(status *Status) error {
+	return nil
+}
+
+/* Stop the backfill; the remaining intervals are uploaded after a restart. */
+func (s *PvOutputSink) Close() error {
+	s.lock.Lock()
+	backfilling := s.backfilling
+	close(s.stop)
+	s.lock.Unlock()
+	if backfilling {
+		<-s.stopped
+	}
+	return nil
+}
+
+/*
+Upload the status once an interval has passed. Missed intervals are
+handed to the backfill.
+*/
+func (s *PvOutputSink) PublishDatagram(data *Datagram, forced bool) error {
+	now := time.Now()
+	slot := s.slot(now)
+	if !slot.After(s.last) || now.Before(s.waitUntil()) {
+		return nil
+	}
+
+	if s.env.History != nil && !s.last.IsZero() && slot.Sub(s.last) > s.interval {
+		s.addGap(s.last.Add(s.interval), slot)
+	}
+	if s.env.History != nil {
+		s.startBackfill()
+	}
+
+	if data.Status == "Normal" {
+		values := url.Values{}
+		values.Set("d", slot.Format("20060102"))
+		values.Set("t", slot.Format("15:04"))
+		values.Set("v1", fmt.Sprintf("%.0f", s.energy(float64(data.DayEnergy), float64(data.DayProduction))))
+		values.Set("v2", fmt.Sprintf("%.0f", data.Power))
+		values.Set("v5", fmt.Sprintf("%.1f", data.Temperature))
+		values.Set("v6", fmt.Sprintf("%.1f", data.VoltageGrid))
+		if err := s.post("addstatus.jsp", values); err != nil {
+			s.delay(now.Add(time.Minute))
+			return err
+		}
+	}
+	s.store(slot)
+	return nil
+}
+
+/* Add the intervals from (including) to (excluding) to the backfill. */
+func (s *PvOutputSink) addGap(from time.Time, to time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.gapFrom.IsZero() || from.Before(s.gapFrom) {
+		s.gapFrom = from
+	}
+	if to.After(s.gapTo) {
+		s.gapTo = to
+	}
+	s.storeGap()
+}
+
+/* Start the backfill if intervals are missing and it is not running. */
+func (s *PvOutputSink) startBackfill() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.backfilling || !s.gapFrom.Before(s.gapTo) {
+		return
+	}
+	s.backfilling = true
+	s.stopped = make(chan struct{})
+	go s.backfill()
+}
+
+/*
+Upload the missed intervals from the history in batches, as averages
+over each interval. Intervals without production are skipped. The
+progress is saved after each batch.
+*/
+func (s *PvOutputSink) backfill() {
+	defer close(s.stopped)
+	for {
+		s.lock.Lock()
+		from, to := s.gapFrom, s.gapTo
+		wait := s.retryAt
+		if s.remaining >= 0 && s.remaining <= pvOutputReserve && s.reset.After(wait) {
+			wait = s.reset
+		}
+		if !from.Before(to) {
+			s.gapFrom, s.gapTo = time.Time{}, time.Time{}
+			s.storeGap()
+			s.backfilling = false
+			s.lock.Unlock()
+			return
+		}
+		s.lock.Unlock()
+
+		if time.Now().Before(wait) {
+			select {
+			case <-time.After(time.Until(wait)):
+			case <-s.stop:
+				s.lock.Lock()
+				s.backfilling = false
+				s.lock.Unlock()
+				return
+			}
+			continue
+		}
+
+		oldest := s.slot(time.Now().AddDate(0, 0, -14))
+		if from.Before(oldest) {
+			from = oldest
+		}
+		end := from.Add(pvOutputBatch * s.interval)
+		if end.After(to) {
+			end = to
+		}
+		if err := s.upload(from, end); err != nil {
+			s.delay(time.Now().Add(time.Minute))
+			continue
+		}
+
+		s.lock.Lock()
+		if s.gapFrom.Before(end) {
+			s.gapFrom = end
+		}
+		s.storeGap()
+		s.lock.Unlock()
+	}
+}
+
+/* Upload the statuses of the intervals ending from (including) to (excluding). */
+func (s *PvOutputSink) upload(from time.Time, to time.Time) error {
+	statuses := make([]string, 0)
+	for _, agg := range s.env.History.Query(from.Add(-s.interval), to.Add(-s.interval), s.interval) {
+		if agg.Max["Power"] <= 0 {
+			continue
+		}
+		// A status holds the values of the interval which ends at its time
+		end := agg.Start.Add(s.interval)
+		statuses = append(statuses, fmt.Sprintf("%s,%s,%.0f,%.0f,,,%.1f,%.1f",
+			end.Format("20060102"), end.Format("15:04"),
+			s.energy(agg.Max["DayEnergy"], agg.Max["DayProduction"]),
+			agg.Avg["Power"], agg.Avg["Temperature"], agg.Avg["VoltageGrid"]))
+	}
+	if len(statuses) == 0 {
+		return nil
+	}
+	diag.Info(fmt.Sprintf("Uploading %d missed statuses to PVOutput.", len(statuses)))
+	return s.post("addbatchstatus.jsp", url.Values{"data": {strings.Join(statuses, ";")}})
+}
+
+/*
+Post to the service. The rate limit of the response is kept; once it is
+exhausted, requests are postponed until it is reset.
+*/
+func (s *PvOutputSink) post(service string, values url.Values) error {
+	request, err := http.NewRequest("POST", strings.TrimSuffix(pvOutputURL, "/")+"/"+service,
+		strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("X-Pvoutput-Apikey", pvOutputKey)
+	request.Header.Set("X-Pvoutput-SystemId", pvOutputSystem)
+	request.Header.Set("X-Rate-Limit", "1")
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		diag.Warn("PVOutput not available: " + err.Error())
+		return err
+	}
+	defer response.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 256))
+	s.rateLimit(response)
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(message)))
+		diag.Warn("PVOutput refused " + service + ": " + err.Error())
+		return err
+	}
+	return nil
+}
+
+/* Keep the rate limit of the response (X-Rate-Limit-Remaining and -Reset). */
+func (s *PvOutputSink) rateLimit(response *http.Response) {
+	remaining, err := strconv.Atoi(response.Header.Get("X-Rate-Limit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset := time.Now().Add(time.Hour)
+	if seconds, err := strconv.ParseInt(response.Header.Get("X-Rate-Limit-Reset"), 10, 64); err == nil {
+		reset = time.Unix(seconds, 0)
+	}
+
+	s.lock.Lock()
+	s.remaining = remaining
+	s.reset = reset
+	s.lock.Unlock()
+	if remaining <= 0 || response.StatusCode == http.StatusForbidden {
+		diag.Warn("PVOutput rate limit reached; waiting until " + reset.Format("15:04:05"))
+		s.delay(reset)
+	}
+}
+
+/* Postpone all requests until the given time. */
+func (s *PvOutputSink) delay(until time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if until.After(s.retryAt) {
+		s.retryAt = until
+	}
+}
+
+func (s *PvOutputSink) waitUntil() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.retryAt
+}
+
+/* The energy in Wh, preferring the integrated energy. */
+func (s *PvOutputSink) energy(dayEnergy float64, dayProduction float64) float64 {
+	if dayEnergy > 0 {
+		return dayEnergy
+	}
+	return dayProduction * 1000
+}
+
+/* The end of the last complete interval at the given time. */
+func (s *PvOutputSink) slot(t time.Time) time.Time {
+	local := t.In(s.env.Rollover.Location())
+	midnight := s.env.Rollover.StartOfDay(local)
+	return midnight.Add(local.Sub(midnight) / s.interval * s.interval)
+}
+
+/* Keep the last uploaded interval, also over restarts. */
+func (s *PvOutputSink) store(slot time.Time) {
+	s.last = slot
+	if s.lastFile != "" {
+		_ = os.WriteFile(s.lastFile, []byte(slot.Format(time.RFC3339)), 0644)
+	}
+}
+
+/* Keep the intervals still to backfill, also over restarts. */
+func (s *PvOutputSink) storeGap() {
+	if s.backfillFile == "" {
+		return
+	}
+	if !s.gapFrom.Before(s.gapTo) {
+		_ = os.Remove(s.backfillFile)
+		return
+	}
+	content := s.gapFrom.Format(time.RFC3339) + " " + s.gapTo.Format(time.RFC3339)
+	_ = os.WriteFile(s.backfillFile, []byte(content), 0644)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* A stand-in for PVOutput which accepts the statuses of system 42. */
+func newPvOutputServer(t *testing.T, remaining int) *standInServer {
+	return newStandInServer(t, func(w http.ResponseWriter, r *recordedRequest) {
+		if r.Header.Get("X-Pvoutput-Apikey") != "key" || r.Header.Get("X-Pvoutput-SystemId") != "42" {
+			http.Error(w, "Unauthorized 401: Invalid API Key", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Rate-Limit") == "1" {
+			w.Header().Set("X-Rate-Limit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("X-Rate-Limit-Limit", "60")
+			w.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		}
+		w.Write([]byte("OK 200: Added Status"))
+	})
+}
+
+/* The statuses posted to the service, one per request. */
+func pvOutputStatuses(server *standInServer, service string) []string {
+	var statuses []string
+	for _, request := range server.received(service) {
+		form, _ := url.ParseQuery(request.Body)
+		status := form.Get("data")
+		if status == "" {
+			status = form.Get("d") + "," + form.Get("t") + "," + form.Get("v2")
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func backfilling(sink *PvOutputSink) bool {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return sink.backfilling
+}
+
+func newTestPvOutputSink(t *testing.T, server *standInServer, history *History) *PvOutputSink {
+	setFlag(t, &datadir, t.TempDir())
+	setFlag(t, &pvOutputKey, "key")
+	setFlag(t, &pvOutputSystem, "42")
+	setFlag(t, &pvOutputInterval, 5)
+	setFlag(t, &pvOutputURL, server.URL)
+	sink, _ := newPvOutputSink(&SinkEnv{History: history, Rollover: NewRollover("")})
+	if sink == nil {
+		t.Fatal("no PVOutput sink")
+	}
+	return sink.(*PvOutputSink)
+}
+
+func TestPvOutputStatus(t *testing.T) {
+	server := newPvOutputServer(t, 59)
+	sink := newTestPvOutputSink(t, server, nil)
+
+	data := &Datagram{Status: "Normal", Power: 812, Timestamp: time.Now()}
+	if err := sink.PublishDatagram(data, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.PublishDatagram(data, false); err != nil {
+		t.Fatal(err)
+	}
+	statuses := pvOutputStatuses(server, "addstatus.jsp")
+	if len(statuses) != 1 {
+		t.Fatalf("%d statuses in one interval, want 1", len(statuses))
+	}
+	slot := sink.slot(time.Now())
+	if status := statuses[0]; status != slot.Format("20060102,15:04")+",812" {
+		t.Errorf("status = %q", status)
+	}
+	if content, err := os.ReadFile(sink.lastFile); err != nil || string(content) != slot.Format(time.RFC3339) {
+		t.Errorf("last interval = %q, %v", content, err)
+	}
+}
+
+func TestPvOutputRateLimit(t *testing.T) {
+	server := newPvOutputServer(t, 0)
+	sink := newTestPvOutputSink(t, server, nil)
+
+	data := &Datagram{Status: "Normal", Power: 812, Timestamp: time.Now()}
+	if err := sink.PublishDatagram(data, false); err != nil {
+		t.Fatal(err)
+	}
+	// The next interval is postponed until the limit is reset
+	sink.last = sink.last.Add(-sink.interval)
+	if err := sink.PublishDatagram(data, false); err != nil {
+		t.Fatal(err)
+	}
+	if count := len(server.received("addstatus.jsp")); count != 1 {
+		t.Errorf("%d requests after the rate limit was reached, want 1", count)
+	}
+	if wait := time.Until(sink.waitUntil()); wait < 59*time.Minute {
+		t.Errorf("waiting %s, want until the reset", wait)
+	}
+}
+
+func TestPvOutputBackfill(t *testing.T) {
+	server := newPvOutputServer(t, 59)
+	rollover := NewRollover("")
+	history := NewHistory(t.TempDir(), rollover)
+	t.Cleanup(history.Close)
+	sink := newTestPvOutputSink(t, server, history)
+
+	// Three hours of production, missed by PVOutput
+	slot := sink.slot(time.Now())
+	for minute := 180; minute > 0; minute-- {
+		history.Add(&Datagram{Status: "Normal", Power: 500, Timestamp: slot.Add(-time.Duration(minute) * time.Minute)})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(history.Query(slot.Add(-3*time.Hour), slot, time.Minute)) < 180 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sink.last = slot.Add(-3 * time.Hour)
+
+	data := &Datagram{Status: "Normal", Power: 812, Timestamp: time.Now()}
+	if err := sink.PublishDatagram(data, false); err != nil {
+		t.Fatal(err)
+	}
+	for backfilling(sink) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if backfilling(sink) {
+		t.Fatal("backfill not finished")
+	}
+
+	batches := pvOutputStatuses(server, "addbatchstatus.jsp")
+	statuses := 0
+	for _, batch := range batches {
+		count := len(strings.Split(batch, ";"))
+		if count > pvOutputBatch {
+			t.Errorf("%d statuses in a batch", count)
+		}
+		statuses += count
+	}
+	// The intervals after the last upload up to the current one
+	if statuses != 35 || len(batches) != 2 {
+		t.Errorf("%d statuses in %d batches, want 35 in 2", statuses, len(batches))
+	}
+	if _, err := os.Stat(sink.backfillFile); !os.IsNotExist(err) {
+		t.Errorf("backfill progress not removed: %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,6 +1,10 @@
 package reader
 
-import "sync"
+import (
+	"sync"
+
+	"growattrr/diag"
+)
 
 type Element struct {
 	data interface{}
@@ -41,6 +45,7 @@ func (qd *Queue) Push(data interface{}) {
 		shrinkSize := len(qd.container) / 3
 		qd.container = qd.container[shrinkSize:]
 		qd.counter = len(qd.container)
+		diag.QueueOverflows.Add(1)
 	}
 	qd.lock.Unlock()
 }
@@ -3,9 +3,9 @@ package reader
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -54,7 +54,8 @@ func (r *Reader) GetQueue() *Queue {
 /*
 	Starts and monitors the serial reader. If it terminates, it will restart
 	the reader (with reinitialisation of the inverter on wakeup). If init
-	fails, queue will be cleared and sleep of 10 minutes is induced.
+	fails, queue will be cleared and sleep of 10 minutes is induced. If the
+	port cannot be opened, it is retried every 10 seconds.
 */
 func (r *Reader) StartMonitored() {
 
@@ -63,12 +64,20 @@ func (r *Reader) StartMonitored() {
 	for {
 		if strings.Compare(r.InitStatus, "OK") != 0 {
 			r.dataqueue.Clear()
-			r.InitLogger()
+			if err := r.InitLogger(); err != nil {
+				diag.Warn("Initialisation failed: " + err.Error())
+			}
 		}
 
 		// count := 0
 		diag.Info("Serial reader starting.")
-		status := r.start()
+		status, err := r.start()
+		if err != nil {
+			r.Status = "Cannot open " + r.device
+			diag.Warn("Reading failed: " + err.Error())
+			time.Sleep(10 * time.Second)
+			continue
+		}
 		r.Status = "Stopped reading."
 		diag.Warn("Reading stopped (" + strconv.FormatBool(status) + ").")
 	}
@@ -84,7 +93,9 @@ func (r *Reader) startPoking() {
 		if span > 15*time.Minute {
 			diag.Warn("Restart needed. Reader can't read data.")
 			// _ = r.connection.Close()
-			r.InitLogger()
+			if err := r.InitLogger(); err != nil {
+				diag.Warn("Initialisation failed: " + err.Error())
+			}
 			// diag.Verbose("Poke done.")
 		}
 	}
@@ -93,10 +104,12 @@ func (r *Reader) startPoking() {
 /*
 	Opens (and closes) the communication port and initializes the Growatt
 	inverter to start sending the datagram	data. It *should* only send
-	every 1.5 seconds, but currently I receive data continuously.
+	every 1.5 seconds, but currently I receive data continuously. Returns
+	an error if the port cannot be opened or the inverter refused.
 */
-func (r *Reader) InitLogger() bool {
+func (r *Reader) InitLogger() error {
 	diag.Info("Sending initialisation to inverter...")
+	diag.InitAttempts.Add(1)
 	r.InitStatus = "Starting"
 	options := serial.OpenOptions{
 		PortName:              r.device,
@@ -110,7 +123,8 @@ func (r *Reader) InitLogger() bool {
 	conn, err := serial.Open(options)
 	if err != nil {
 		r.InitStatus = "Failed to open connection"
-		log.Fatalf("[ERROR] serial.Open: %v", err)
+		diag.InitFailures.Add(1)
+		return fmt.Errorf("serial.Open: %w", err)
 	}
 	defer conn.Close()
 	r.InitStatus = "Initializing"
@@ -121,22 +135,29 @@ func (r *Reader) InitLogger() bool {
 
 	if !status {
 		r.InitStatus = "Failed on sending request"
-		return false
+		diag.InitFailures.Add(1)
+		return errors.New("init not accepted by the inverter")
 	}
 	r.InitStatus = "Commiting request"
 
 	status = r.sendCommand(conn, "Commit", []byte{
 		0x3F, 0x23, 0x7E, 0x34, 0x42, 0x7E, 0x23, 0x3F})
 
+	if !status {
+		r.InitStatus = "Failed on commit"
+		diag.InitFailures.Add(1)
+		return errors.New("commit not accepted by the inverter")
+	}
 	r.InitStatus = "OK"
 	diag.Info("Sent init command to Growatt inverter.")
-	return status
+	return nil
 }
 
 func (r *Reader) sendCommand(conn io.ReadWriteCloser, task string, data []byte) bool {
 	_, err1 := conn.Write(data)
 	if err1 != nil {
-		log.Fatalf("[ERROR] serial.sendCommand: %v", err1)
+		diag.Warn(task + " not sent: " + err1.Error())
+		return false
 	}
 	time.Sleep(250 * time.Millisecond)
 
@@ -174,9 +195,10 @@ func (r *Reader) sendCommand(conn io.ReadWriteCloser, task string, data []byte)
 }
 
 /*
-	Starts reading until read failure or respawn of the inverter
+	Starts reading until read failure or respawn of the inverter. Returns
+	an error if the port cannot be opened.
 */
-func (r *Reader) start() bool {
+func (r *Reader) start() (bool, error) {
 	options := serial.OpenOptions{
 		PortName:          r.device,
 		BaudRate:          r.speed,
@@ -194,7 +216,7 @@ func (r *Reader) start() bool {
 	// Open the port.
 	conn, err := serial.Open(options)
 	if err != nil {
-		log.Fatalf("[ERROR] serial.Open: %v", err)
+		return false, fmt.Errorf("serial.Open: %w", err)
 	}
 	// Make sure to close it later.
 	defer conn.Close()
@@ -213,12 +235,15 @@ func (r *Reader) start() bool {
 
 		span := time.Since(r.lastUpdate)
 		r.lastUpdate = time.Now()
+		diag.BytesRead.Add(int64(n))
+		diag.LastRead.Store(r.lastUpdate.Unix())
 		if span > 5*time.Minute {
 			diag.Warn("Respawning...")
+			diag.Reconnects.Add(1)
 			r.dataqueue.Clear()
 			_ = conn.Close()
 			r.connection = nil
-			return true
+			return true, nil
 		}
 
 		if !reading {
@@ -233,5 +258,5 @@ func (r *Reader) start() bool {
 			r.dataqueue.Push(buffer[i])
 		}
 	}
-	return false
+	return false, nil
 }
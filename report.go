@@ -0,0 +1,228 @@
+// report
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Production report of a day, month or year. The coverage is the share
+(%) of the minutes between first and last production with data. The
+production hours are the minutes in which the inverter produced. A month
+or year report includes the reports of its days or months.
+*/
+type Report struct {
+	Period          string
+	Key             string
+	Energy          float64
+	PeakPower       float64
+	PeakTime        *time.Time `json:",omitempty"`
+	FirstProduction *time.Time `json:",omitempty"`
+	LastProduction  *time.Time `json:",omitempty"`
+	Faults          int
+	FaultCodes      []int `json:",omitempty"`
+	Coverage        float64
+	ProductionHours float64
+	Details         []*Report `json:",omitempty"`
+
+	minutes int
+	span    float64
+}
+
+/* Layout of the key for each period. */
+var reportPeriods = map[string]string{
+	"day":   "2006-01-02",
+	"month": "2006-01",
+	"year":  "2006",
+}
+
+/*
+Create the report of the period (day, month or year) starting at start.
+Nil if there is no data.
+*/
+func (h *History) Report(period string, start time.Time) *Report {
+	switch period {
+	case "day":
+		aggregates := h.Query(start, start.AddDate(0, 0, 1), oneDay)
+		if len(aggregates) == 0 {
+			return nil
+		}
+		return dayReport(aggregates[0])
+	case "month":
+		details := make([]*Report, 0)
+		for _, agg := range h.Query(start, start.AddDate(0, 1, 0), oneDay) {
+			details = append(details, dayReport(agg))
+		}
+		return combineReports("month", start.Format(reportPeriods["month"]), details)
+	case "year":
+		details := make([]*Report, 0)
+		for month := start; month.Year() == start.Year(); month = month.AddDate(0, 1, 0) {
+			if report := h.Report("month", month); report != nil {
+				report.Details = nil
+				details = append(details, report)
+			}
+		}
+		return combineReports("year", start.Format(reportPeriods["year"]), details)
+	}
+	return nil
+}
+
+func dayReport(agg *Aggregate) *Report {
+	report := &Report{
+		Period:          "day",
+		Key:             dayOf(agg.Start),
+		Energy:          agg.Max["DayProduction"],
+		PeakPower:       agg.Max["Power"],
+		PeakTime:        agg.PeakTime,
+		FirstProduction: agg.FirstProduction,
+		LastProduction:  agg.LastProduction,
+		Faults:          agg.Faults,
+		FaultCodes:      agg.FaultCodes,
+		minutes:         agg.Minutes,
+	}
+	if agg.FirstProduction != nil {
+		// Whole minutes, as the minutes with data are counted
+		report.span = float64(agg.LastProduction.Unix()/60 - agg.FirstProduction.Unix()/60 + 1)
+	}
+	report.ProductionHours = roundTo(float64(agg.ProductionMinutes)/60, 2)
+	// Aggregates of previous versions only have the first and last production
+	if agg.ProductionMinutes == 0 && agg.FirstProduction != nil {
+		report.ProductionHours = roundTo(agg.LastProduction.Sub(*agg.FirstProduction).Hours(), 2)
+	}
+	report.Coverage = coverage(report.minutes, report.span)
+	return report
+}
+
+func combineReports(period string, key string, details []*Report) *Report {
+	if len(details) == 0 {
+		return nil
+	}
+	report := &Report{Period: period, Key: key, Details: details}
+	for _, detail := range details {
+		report.Energy += detail.Energy
+		if detail.PeakPower > report.PeakPower {
+			report.PeakPower = detail.PeakPower
+			report.PeakTime = detail.PeakTime
+		}
+		if detail.FirstProduction != nil &&
+			(report.FirstProduction == nil || detail.FirstProduction.Before(*report.FirstProduction)) {
+			report.FirstProduction = detail.FirstProduction
+		}
+		if detail.LastProduction != nil &&
+			(report.LastProduction == nil || detail.LastProduction.After(*report.LastProduction)) {
+			report.LastProduction = detail.LastProduction
+		}
+		report.Faults += detail.Faults
+		for _, code := range detail.FaultCodes {
+			known := false
+			for _, other := range report.FaultCodes {
+				known = known || other == code
+			}
+			if !known {
+				report.FaultCodes = append(report.FaultCodes, code)
+			}
+		}
+		report.minutes += detail.minutes
+		report.span += detail.span
+		report.ProductionHours += detail.ProductionHours
+	}
+	report.Energy = roundTo(report.Energy, 1)
+	report.ProductionHours = roundTo(report.ProductionHours, 2)
+	report.Coverage = coverage(report.minutes, report.span)
+	return report
+}
+
+func coverage(minutes int, span float64) float64 {
+	if span <= 0 {
+		return 0
+	}
+	return roundTo(min(100, 100*float64(minutes)/span), 1)
+}
+
+/*
+Get a report, e.g. /reports/day/2026-10-19, /reports/month/2026-10 or
+/reports/year/2026. Use format=csv for CSV instead of JSON.
+*/
+func (p *Publisher) getReport(w http.ResponseWriter, r *http.Request) {
+	period := mux.Vars(r)["period"]
+	layout, ok := reportPeriods[period]
+	if !ok {
+		http.Error(w, "Invalid period (day, month or year)", http.StatusNotFound)
+		return
+	}
+	start, err := time.ParseInLocation(layout, mux.Vars(r)["key"], p.history.location)
+	if err != nil {
+		http.Error(w, "Invalid "+period+" ("+layout+")", http.StatusBadRequest)
+		return
+	}
+	report := p.history.Report(period, start)
+	if report == nil {
+		http.Error(w, "No data for "+mux.Vars(r)["key"], http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" || r.Header.Get("Accept") == "text/csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		writer := csv.NewWriter(w)
+		_ = writer.Write([]string{"Period", "Key", "Energy", "PeakPower", "PeakTime",
+			"FirstProduction", "LastProduction", "Faults", "Coverage", "ProductionHours"})
+		for _, detail := range append(report.Details, report) {
+			_ = writer.Write([]string{detail.Period, detail.Key,
+				strconv.FormatFloat(detail.Energy, 'f', -1, 64),
+				strconv.FormatFloat(detail.PeakPower, 'f', -1, 64),
+				formatOptional(detail.PeakTime),
+				formatOptional(detail.FirstProduction),
+				formatOptional(detail.LastProduction),
+				strconv.Itoa(detail.Faults),
+				strconv.FormatFloat(detail.Coverage, 'f', -1, 64),
+				strconv.FormatFloat(detail.ProductionHours, 'f', -1, 64)})
+		}
+		writer.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+func formatOptional(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+/*
+The reports closed with the day: the day report and, at the end of a
+month or year, the month or year report.
+*/
+func (h *History) closedReports(closed DayClosed) []*Report {
+	start, err := time.ParseInLocation("2006-01-02", closed.Day, h.location)
+	if err != nil {
+		return nil
+	}
+
+	today := closed.Closed.In(h.location)
+	reports := []*Report{h.Report("day", start)}
+	if today.Month() != start.Month() {
+		month := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, h.location)
+		reports = append(reports, h.Report("month", month))
+	}
+	if today.Year() != start.Year() {
+		year := time.Date(start.Year(), 1, 1, 0, 0, 0, 0, h.location)
+		reports = append(reports, h.Report("year", year))
+	}
+
+	result := make([]*Report, 0, len(reports))
+	for _, report := range reports {
+		if report != nil {
+			result = append(result, report)
+		}
+	}
+	return result
+}
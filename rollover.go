@@ -0,0 +1,153 @@
+// rollover
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"growattrr/diag"
+)
+
+/*
+Event of a production day which has been closed, holding the final
+daily total.
+*/
+type DayClosed struct {
+	Day    string
+	Energy float32
+	Closed time.Time
+}
+
+/*
+Decides when a new production day starts. The day is determined by the
+local date in the configured time zone, which is cross-checked with the
+reset of the DayProduction counter by the inverter itself.
+*/
+type Rollover struct {
+	location     *time.Location
+	lock         *sync.Mutex
+	day          string
+	dayEnergy    float32
+	closedEnergy float32
+	awaitReset   bool
+	listeners    []func(DayClosed)
+}
+
+/*
+Create a rollover for the time zone (e.g. Europe/Amsterdam). It falls
+back to the local time zone if the zone is empty or unknown.
+*/
+func NewRollover(zone string) *Rollover {
+	r := new(Rollover)
+	r.lock = &sync.Mutex{}
+	r.location = time.Local
+	if zone != "" && zone != "Local" {
+		location, err := time.LoadLocation(zone)
+		if err != nil {
+			diag.Warn("Unknown time zone '" + zone + "', using local time.")
+		} else {
+			r.location = location
+		}
+	}
+	r.day = dayOf(r.Now())
+	return r
+}
+
+/* The current time in the time zone of the rollover. */
+func (r *Rollover) Now() time.Time {
+	return time.Now().In(r.location)
+}
+
+/* The time zone of the rollover. */
+func (r *Rollover) Location() *time.Location {
+	return r.location
+}
+
+/* The current production day (yyyy-mm-dd). */
+func (r *Rollover) Today() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.day
+}
+
+/* The start (midnight) of the given time in the time zone of the rollover. */
+func (r *Rollover) StartOfDay(t time.Time) time.Time {
+	local := t.In(r.location)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, r.location)
+}
+
+/*
+Register a listener which is called for every closed day. Listeners are
+called by the observer (outside the lock of the rollover), so they must
+not block; start a goroutine for longer work.
+*/
+func (r *Rollover) OnDayClosed(listener func(DayClosed)) {
+	r.lock.Lock()
+	r.listeners = append(r.listeners, listener)
+	r.lock.Unlock()
+}
+
+/*
+Restore the day and its production as persisted. A day in the past is
+closed on the next observation.
+*/
+func (r *Rollover) Restore(day string, energy float32) {
+	r.lock.Lock()
+	r.day = day
+	r.dayEnergy = energy
+	r.lock.Unlock()
+}
+
+/*
+Observe the DayProduction of the inverter at the given time and return
+the value to use for the current day. If the data is not measured (e.g.
+while sleeping) the accumulated value of the day is returned.
+
+After the day changed, the inverter may still report the total of the
+previous day until it resets its own counter. Such values (unchanged
+since the day closed) are returned as zero until the counter changes;
+a lower value is the reset, a higher value is production of the new
+day (e.g. after a restart during the day).
+*/
+func (r *Rollover) Observe(now time.Time, dayProduction float32, measured bool) float32 {
+	r.lock.Lock()
+
+	var closed *DayClosed
+	today := dayOf(now.In(r.location))
+	if today != r.day {
+		closed = &DayClosed{Day: r.day, Energy: r.dayEnergy, Closed: now}
+		r.closedEnergy = r.dayEnergy
+		r.awaitReset = r.dayEnergy > 0
+		r.dayEnergy = 0
+		r.day = today
+	}
+
+	result := r.dayEnergy
+	if measured {
+		if r.awaitReset && math.Abs(float64(dayProduction-r.closedEnergy)) < 0.05 {
+			diag.Verbose(fmt.Sprintf("Ignoring %.1f kWh of the previous day.", dayProduction))
+			result = 0
+		} else {
+			if r.awaitReset {
+				r.awaitReset = false
+			} else if dayProduction < r.dayEnergy {
+				diag.Warn(fmt.Sprintf("Inverter reset day production (%.1f to %.1f kWh) on %s. Check the time zone!",
+					r.dayEnergy, dayProduction, today))
+			}
+			r.dayEnergy = dayProduction
+			result = dayProduction
+		}
+	}
+	listeners := r.listeners
+	r.lock.Unlock()
+
+	if closed != nil {
+		diag.Info(fmt.Sprintf("Day %s closed with %.1f kWh.", closed.Day, closed.Energy))
+		for _, listener := range listeners {
+			listener(*closed)
+		}
+	}
+	return result
+}
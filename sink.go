@@ -0,0 +1,274 @@
+// sink
+package main
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"growattrr/diag"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+A destination of the publisher (e.g. MQTT or files). A sink is called
+for each publication cycle with the latest datagram and whenever the
+status changes. If forced, a sink should publish all values.
+*/
+type Sink interface {
+	Init() error
+	PublishDatagram(data *Datagram, forced bool) error
+	PublishStatus(status *Status) error
+	Close() error
+}
+
+/* A sink which serves its own endpoints on the REST server. */
+type RouteProvider interface {
+	Routes(router *mux.Router)
+}
+
+/* A sink whose number of decimals can be changed, e.g. by a command. */
+type PrecisionSetter interface {
+	SetPrecision(decimals int)
+}
+
+/* Policies for publishing datagrams to a sink. */
+const (
+	PublishAlways = iota // Every publication cycle
+	PublishNew           // Only new datagrams
+)
+
+/*
+Options of a sink: the minimum interval between publications (0 is no
+limit) and the policy to detect changes.
+*/
+type SinkOptions struct {
+	Interval time.Duration
+	Policy   int
+}
+
+/* Shared components available to sinks. */
+type SinkEnv struct {
+	History  *History
+	Rollover *Rollover
+	Commands chan<- *Command
+}
+
+/*
+Creates a sink from its configuration (i.e. the command line flags).
+Returns nil if the sink is not configured.
+*/
+type SinkFactory func(env *SinkEnv) (Sink, SinkOptions)
+
+var sinkFactories = make(map[string]SinkFactory)
+var sinkNames []string
+
+/* Register a sink by name, typically in the init of its file. */
+func RegisterSink(name string, factory SinkFactory) {
+	sinkFactories[name] = factory
+	sinkNames = append(sinkNames, name)
+}
+
+/* Counters of a sink as shown in the info. */
+type SinkInfo struct {
+	Name        string
+	Published   int64
+	Skipped     int64
+	Errors      int64
+	LastError   string    `json:",omitempty"`
+	LastPublish time.Time `json:",omitempty"`
+}
+
+/*
+Runs a sink on its own goroutine, so a slow sink (e.g. a broker or server
+which does not respond) does not delay the others: applies its rate
+limit and change detection and keeps track of its counters. The runner
+only keeps the latest datagram and status; if the sink cannot keep up,
+the datagrams in between are skipped.
+*/
+type sinkRunner struct {
+	sink       Sink
+	options    SinkOptions
+	last       *Datagram
+	next       time.Time
+	statusNext time.Time
+	lock       *sync.Mutex
+	info       SinkInfo
+	pending    *Datagram
+	forced     bool
+	status     *Status
+	closed     bool
+	wake       chan struct{}
+	done       chan struct{}
+}
+
+/* Minimum period between two status publications of a sink. */
+const statusInterval = 5 * time.Second
+
+/* Maximum time to wait for a sink to finish on termination. */
+const sinkCloseTimeout = 10 * time.Second
+
+/* Create and initialize all configured sinks. */
+func createSinks(env *SinkEnv) []*sinkRunner {
+	runners := make([]*sinkRunner, 0)
+	for _, name := range sinkNames {
+		sink, options := sinkFactories[name](env)
+		if sink == nil || reflect.ValueOf(sink).IsNil() {
+			continue
+		}
+		diag.Info("Publishing to sink " + name)
+		runner := &sinkRunner{sink: sink, options: options, lock: &sync.Mutex{}}
+		runner.info.Name = name
+		runner.wake = make(chan struct{}, 1)
+		runner.done = make(chan struct{})
+		if err := sink.Init(); err != nil {
+			diag.Warn("Sink " + name + " failed to initialize: " + err.Error())
+			runner.failed(err)
+		}
+		go runner.run()
+		runners = append(runners, runner)
+	}
+	return runners
+}
+
+/* Hand the datagram of a publication cycle to the sink. */
+func (r *sinkRunner) offer(data *Datagram, forced bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	if r.pending != nil && r.pending != data {
+		r.info.Skipped++
+	}
+	r.pending = data
+	r.forced = r.forced || forced
+	r.signal()
+}
+
+/* Hand a changed status to the sink. */
+func (r *sinkRunner) offerStatus(status Status) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return
+	}
+	r.status = &status
+	r.signal()
+}
+
+func (r *sinkRunner) signal() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Publish what has been offered. A changed status is published at most
+once per statusInterval; a later change replaces one not yet published.
+*/
+func (r *sinkRunner) run() {
+	defer close(r.done)
+	for range r.wake {
+		r.lock.Lock()
+		data, forced := r.pending, r.forced
+		r.pending, r.forced = nil, false
+		var status *Status
+		if r.status != nil && !time.Now().Before(r.statusNext) {
+			status, r.status = r.status, nil
+		}
+		r.lock.Unlock()
+
+		if data != nil {
+			r.publish(data, forced)
+		}
+		if status != nil {
+			r.statusNext = time.Now().Add(statusInterval)
+			r.publishStatus(status)
+		}
+	}
+}
+
+/* Change the minimum interval between publications, e.g. by a command. */
+func (r *sinkRunner) setInterval(interval time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.options.Interval = interval
+	r.next = time.Time{}
+}
+
+func (r *sinkRunner) publish(data *Datagram, forced bool) {
+	if !forced {
+		if r.options.Policy == PublishNew && data == r.last {
+			return
+		}
+		r.lock.Lock()
+		limited := r.options.Interval > 0 && time.Now().Before(r.next)
+		if !limited && r.options.Interval > 0 {
+			r.next = time.Now().Add(r.options.Interval)
+		}
+		r.lock.Unlock()
+		if limited {
+			r.skipped()
+			return
+		}
+	}
+	r.last = data
+
+	if err := r.sink.PublishDatagram(data, forced); err != nil {
+		r.failed(err)
+		return
+	}
+	r.lock.Lock()
+	r.info.Published++
+	r.info.LastPublish = time.Now()
+	r.lock.Unlock()
+}
+
+func (r *sinkRunner) publishStatus(status *Status) {
+	if err := r.sink.PublishStatus(status); err != nil {
+		r.failed(err)
+	}
+}
+
+/*
+Stop the runner, waiting (up to sinkCloseTimeout) for the publication in
+progress, and close the sink.
+*/
+func (r *sinkRunner) close() error {
+	r.lock.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.wake)
+	}
+	r.lock.Unlock()
+
+	select {
+	case <-r.done:
+	case <-time.After(sinkCloseTimeout):
+		diag.Warn("Sink " + r.info.Name + " does not finish; closing it anyway.")
+	}
+	return r.sink.Close()
+}
+
+func (r *sinkRunner) skipped() {
+	r.lock.Lock()
+	r.info.Skipped++
+	r.lock.Unlock()
+}
+
+func (r *sinkRunner) failed(err error) {
+	r.lock.Lock()
+	r.info.Errors++
+	r.info.LastError = time.Now().Format("15:04:05") + " " + err.Error()
+	r.lock.Unlock()
+}
+
+/* A copy of the counters. */
+func (r *sinkRunner) counters() SinkInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.info
+}
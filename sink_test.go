@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/* Set a flag for the duration of the test. */
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	previous := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = previous })
+}
+
+/* A request as received by the stand-in server, with its body. */
+type recordedRequest struct {
+	*http.Request
+	Body   string
+	Failed bool
+}
+
+/*
+A stand-in for the HTTP service of a sink, which records the requests.
+While failing, it answers 503; otherwise respond answers the request.
+*/
+type standInServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []*recordedRequest
+	failing  bool
+}
+
+func newStandInServer(t *testing.T, respond func(http.ResponseWriter, *recordedRequest)) *standInServer {
+	server := new(standInServer)
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := &recordedRequest{Request: r, Body: string(body)}
+		server.lock.Lock()
+		request.Failed = server.failing
+		server.requests = append(server.requests, request)
+		server.lock.Unlock()
+		if request.Failed {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		respond(w, request)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+/* The requests received on the path, or all requests for "". */
+func (s *standInServer) received(path string) []*recordedRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var requests []*recordedRequest
+	for _, request := range s.requests {
+		if path == "" || strings.TrimPrefix(request.URL.Path, "/") == path {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+func (s *standInServer) setFailing(failing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing = failing
+}
@@ -0,0 +1,114 @@
+// state
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"growattrr/diag"
+)
+
+/*
+The state as persisted between restarts: the day of the counters, the
+accumulated counters and the lifecycle state.
+*/
+type State struct {
+	Day             string
+	DayProduction   float32
+	TotalProduction float32
+	OperationHours  float32
+	PeakPower       float32
+	DayEnergy       float32
+	LifetimeEnergy  float32
+	Lifecycle       string
+	LastUpdate      time.Time
+	Saved           time.Time
+}
+
+type StateStore struct {
+	path string
+	lock *sync.Mutex
+}
+
+/*
+Create a state store on the given file. Returns nil if no path is
+given, which disables persistence.
+*/
+func NewStateStore(path string) *StateStore {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		diag.Warn("Cannot create state directory: " + err.Error())
+		return nil
+	}
+	s := new(StateStore)
+	s.path = path
+	s.lock = &sync.Mutex{}
+	return s
+}
+
+/*
+Load the persisted state. Nil if there is none or it is unreadable.
+*/
+func (s *StateStore) Load() *State {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			diag.Warn("Cannot read state: " + err.Error())
+		}
+		return nil
+	}
+	state := new(State)
+	if err := json.Unmarshal(content, state); err != nil {
+		diag.Warn("Ignoring corrupt state: " + err.Error())
+		return nil
+	}
+	return state
+}
+
+/*
+Save the state atomically: write to a temporary file, sync it and
+rename it over the previous state, so a power cut never leaves a
+partial file behind.
+*/
+func (s *StateStore) Save(state *State) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state.Saved = time.Now()
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+/* The day key as used in the state. */
+func dayOf(t time.Time) string {
+	return t.Format("2006-01-02")
+}
@@ -0,0 +1,261 @@
+// stream
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"growattrr/diag"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func init() {
+	RegisterSink("stream", newStreamSink)
+}
+
+/* An event of the live stream. */
+type streamEvent struct {
+	ID    int64           `json:"id"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+/*
+Pushes each new datagram and each status change to the clients of the
+live stream, as Server-Sent Events (/events) or on a WebSocket (/ws).
+The recent events are kept, so a reconnecting client receives the events
+it missed (Last-Event-ID); other clients start with the latest datagram
+and status.
+*/
+type StreamSink struct {
+	lock        sync.Mutex
+	nextID      int64
+	recent      []*streamEvent
+	datagram    *streamEvent
+	status      *streamEvent
+	subscribers map[chan *streamEvent]bool
+}
+
+/* Number of recent events kept for reconnecting clients. */
+const streamRecent = 100
+
+/* Period of the heartbeat which keeps idle connections open. */
+const streamHeartbeat = 15 * time.Second
+
+var upgrader = websocket.Upgrader{}
+
+func newStreamSink(env *SinkEnv) (Sink, SinkOptions) {
+	s := new(StreamSink)
+	// Start at the current time, so the IDs keep increasing over restarts
+	s.nextID = time.Now().UnixMilli()
+	s.subscribers = make(map[chan *streamEvent]bool)
+	return s, SinkOptions{Policy: PublishNew}
+}
+
+func (s *StreamSink) Init() error {
+	return nil
+}
+
+func (s *StreamSink) PublishDatagram(data *Datagram, forced bool) error {
+	return s.broadcast("datagram", data)
+}
+
+func (s *StreamSink) PublishStatus(status *Status) error {
+	return s.broadcast("status", status)
+}
+
+/* Disconnect all clients. */
+func (s *StreamSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for subscriber := range s.subscribers {
+		close(subscriber)
+	}
+	s.subscribers = make(map[chan *streamEvent]bool)
+	return nil
+}
+
+func (s *StreamSink) Routes(router *mux.Router) {
+	router.HandleFunc("/events", s.getEvents).Methods("GET")
+	router.HandleFunc("/ws", s.getWebSocket).Methods("GET")
+}
+
+/* Send the event to all clients; clients which cannot keep up are dropped. */
+func (s *StreamSink) broadcast(name string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	event := &streamEvent{ID: s.nextID, Event: name, Data: data}
+	s.nextID++
+	if name == "datagram" {
+		s.datagram = event
+	} else {
+		s.status = event
+	}
+	s.recent = append(s.recent, event)
+	if len(s.recent) > streamRecent {
+		s.recent = s.recent[len(s.recent)-streamRecent:]
+	}
+
+	for subscriber := range s.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			diag.Info("Dropping slow stream client.")
+			delete(s.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return nil
+}
+
+/*
+Subscribe a client. Returns the events since the given ID, or the latest
+datagram and status if these are no longer known.
+*/
+func (s *StreamSink) subscribe(lastID string) (chan *streamEvent, []*streamEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	subscriber := make(chan *streamEvent, streamRecent)
+	s.subscribers[subscriber] = true
+
+	missed := make([]*streamEvent, 0)
+	if id, err := strconv.ParseInt(lastID, 10, 64); err == nil && len(s.recent) > 0 &&
+		id >= s.recent[0].ID-1 && id < s.nextID {
+		for _, event := range s.recent {
+			if event.ID > id {
+				missed = append(missed, event)
+			}
+		}
+		return subscriber, missed
+	}
+	for _, event := range []*streamEvent{s.status, s.datagram} {
+		if event != nil {
+			missed = append(missed, event)
+		}
+	}
+	return subscriber, missed
+}
+
+func (s *StreamSink) unsubscribe(subscriber chan *streamEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.subscribers[subscriber] {
+		delete(s.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+/*
+Stream the events as Server-Sent Events. Browsers reconnect by themselves
+and send the ID of the last event received.
+*/
+func (s *StreamSink) getEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	subscriber, missed := s.subscribe(lastID)
+	defer s.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	for _, event := range missed {
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Event, event.Data)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, open := <-subscriber:
+			if !open {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Event, event.Data)
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+/*
+Stream the events on a WebSocket as JSON messages with id, event and
+data. A reconnecting client passes the last ID as ?last=<id>.
+*/
+func (s *StreamSink) getWebSocket(w http.ResponseWriter, r *http.Request) {
+	connection, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has responded already
+		return
+	}
+	defer connection.Close()
+
+	subscriber, missed := s.subscribe(r.URL.Query().Get("last"))
+	defer s.unsubscribe(subscriber)
+
+	// Read (and discard) messages to handle pongs and the close of the client
+	closed := make(chan struct{})
+	connection.SetReadDeadline(time.Now().Add(2 * streamHeartbeat))
+	connection.SetPongHandler(func(string) error {
+		return connection.SetReadDeadline(time.Now().Add(2 * streamHeartbeat))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := connection.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, event := range missed {
+		if connection.WriteJSON(event) != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		connection.SetWriteDeadline(time.Now().Add(streamHeartbeat))
+		select {
+		case event, open := <-subscriber:
+			if !open {
+				_ = connection.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			err = connection.WriteJSON(event)
+		case <-heartbeat.C:
+			err = connection.WriteMessage(websocket.PingMessage, nil)
+		case <-closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Dashboard of the Growatt inverter reader: live values from /events,
+// the curve of today from /history and the health from /info.
+"use strict";
+
+const decimals = {
+	Power: 0, PeakPower: 0, DayProduction: 1, TotalProduction: 1,
+	VoltagePV1: 1, VoltagePV2: 1, VoltageBus: 1, VoltageGrid: 1,
+	Frequency: 2, Temperature: 1, OperationHours: 0,
+};
+
+let curve = [];
+
+function show(datagram) {
+	for (const [field, digits] of Object.entries(decimals)) {
+		const value = datagram[field];
+		document.getElementById(field).textContent =
+			typeof value === "number" ? value.toFixed(digits) : "-";
+	}
+	const status = document.getElementById("Status");
+	status.textContent = datagram.Status;
+	status.className = "value" + (datagram.FaultCode > 0 ? " fault" : "");
+	document.getElementById("FaultCode").textContent =
+		datagram.FaultCode >= 0 ? datagram.FaultCode : "-";
+	document.getElementById("Timestamp").textContent =
+		new Date(datagram.Timestamp).toLocaleTimeString();
+
+	// Add a point to the curve at most once a minute
+	const time = new Date(datagram.Timestamp);
+	const last = curve[curve.length - 1];
+	if (datagram.Status !== "Unavailable" && (!last || time - last.time >= 60000)) {
+		curve.push({ time: time, power: datagram.Power || 0 });
+		draw();
+	}
+}
+
+function health(status) {
+	const table = document.getElementById("health");
+	table.replaceChildren();
+	const row = (name, value) => {
+		const tr = table.insertRow();
+		tr.insertCell().textContent = name;
+		tr.insertCell().textContent = value;
+	};
+	row("Reader", status.Reader || "-");
+	row("Interpreter", status.Interpreter || "-");
+	row("Publisher", status.Publisher || "-");
+	row("Init", status.Init || "-");
+	for (const sink of status.Sinks || []) {
+		row("Sink " + sink.Name, sink.Published + " sent, " + sink.Errors + " errors");
+	}
+}
+
+function draw() {
+	const svg = document.getElementById("curve");
+	const width = 800, height = 220, top = 10;
+	const midnight = new Date();
+	midnight.setHours(0, 0, 0, 0);
+	const day = 24 * 3600 * 1000;
+	const today = curve.filter((point) => point.time >= midnight);
+	const peak = Math.max(100, ...today.map((point) => point.power));
+	const scale = Math.pow(10, Math.floor(Math.log10(peak)));
+	const maximum = Math.ceil(peak / scale) * scale;
+
+	const x = (time) => ((time - midnight) / day) * width;
+	const y = (power) => top + height - (power / maximum) * height;
+	const points = today.map((point) => x(point.time).toFixed(1) + "," + y(point.power).toFixed(1));
+
+	let content = "";
+	for (let hour = 0; hour <= 24; hour += 3) {
+		const position = (hour / 24) * width;
+		content += `<line class="axis" x1="${position}" y1="${top}" x2="${position}" y2="${top + height}"/>`;
+		content += `<text x="${Math.min(position + 2, width - 16)}" y="${top + height + 10}">${hour}h</text>`;
+	}
+	content += `<line class="axis" x1="0" y1="${y(0)}" x2="${width}" y2="${y(0)}"/>`;
+	content += `<text x="2" y="${top + 10}">${maximum} W</text>`;
+	if (points.length > 1) {
+		const first = x(today[0].time).toFixed(1), end = x(today[today.length - 1].time).toFixed(1);
+		content += `<polygon class="area" points="${first},${y(0)} ${points.join(" ")} ${end},${y(0)}"/>`;
+		content += `<polyline class="line" points="${points.join(" ")}"/>`;
+	}
+	svg.innerHTML = content;
+}
+
+async function load() {
+	try {
+		const response = await fetch("history?step=5m&fields=Power");
+		if (response.ok) {
+			const rows = await response.json();
+			curve = rows.map((row) => ({ time: new Date(row.Time), power: row.Power || 0 }));
+		}
+	} catch (error) {
+		// Without history the curve starts with the live values
+	}
+	draw();
+
+	try {
+		show(await (await fetch("status")).json());
+		health(await (await fetch("info")).json());
+	} catch (error) {
+		// The stream provides the values once available
+	}
+}
+
+function connect() {
+	const connection = document.getElementById("connection");
+	const events = new EventSource("events");
+	events.onopen = () => {
+		connection.textContent = "Live";
+		connection.className = "badge online";
+	};
+	events.onerror = () => {
+		connection.textContent = "Offline";
+		connection.className = "badge offline";
+	};
+	events.addEventListener("datagram", (event) => show(JSON.parse(event.data)));
+	events.addEventListener("status", (event) => health(JSON.parse(event.data)));
+}
+
+load().then(connect);
+
+// The counters of the sinks are not streamed
+setInterval(async () => {
+	try {
+		health(await (await fetch("info")).json());
+	} catch (error) {
+		// Shown as offline by the stream
+	}
+}, 30000);
+
+// Start a new curve after midnight
+setInterval(draw, 60000);
@@ -0,0 +1,311 @@
+// webhook
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"growattrr/diag"
+)
+
+func init() {
+	RegisterSink("webhook", newWebhookSink)
+}
+
+/*
+The data of a webhook template: the event ("datagram" or "status") with
+the latest datagram and status.
+*/
+type WebhookEvent struct {
+	Event    string
+	Inverter string
+	Site     string
+	Time     time.Time
+	Datagram *Datagram
+	Status   *Status
+}
+
+/* A request which could not be delivered, as kept in the dead-letter file. */
+type webhookRequest struct {
+	Time    time.Time
+	Event   string
+	URL     string
+	Headers map[string]string
+	Body    string
+	Error   string `json:",omitempty"`
+}
+
+/*
+Posts datagrams and status changes to an HTTP endpoint. The URL, headers
+and body are Go templates of a WebhookEvent. Requests are sent in the
+background and retried; requests which still fail are appended to the
+dead-letter file, which is rotated once it exceeds webhookDeadMax.
+*/
+type WebhookSink struct {
+	client     *http.Client
+	url        *template.Template
+	headers    map[string]*template.Template
+	body       *template.Template
+	events     map[string]bool
+	data       *Datagram
+	lock       sync.Mutex
+	closed     bool
+	queue      chan *webhookRequest
+	abort      chan struct{}
+	done       chan struct{}
+	deadLock   sync.Mutex
+	deadLetter string
+}
+
+/* Number of requests waiting to be sent; newer requests are dropped beyond it. */
+const webhookQueue = 100
+
+/* Maximum time to send the waiting requests on termination. */
+const webhookDrain = 30 * time.Second
+
+/* Maximum size of the dead-letter file; the previous file is kept as .1. */
+const webhookDeadMax = 10 * 1024 * 1024
+
+var webhookFuncs = template.FuncMap{
+	"json": func(value any) (string, error) {
+		content, err := json.Marshal(value)
+		return string(content), err
+	},
+	"env": os.Getenv,
+}
+
+func newWebhookSink(env *SinkEnv) (Sink, SinkOptions) {
+	options := SinkOptions{Interval: time.Duration(webhookInterval) * time.Second, Policy: PublishNew}
+	if webhookURL == "" {
+		return nil, options
+	}
+
+	s := new(WebhookSink)
+	var err error
+	if s.url, err = template.New("url").Funcs(webhookFuncs).Parse(webhookURL); err != nil {
+		diag.Warn("Invalid webhook URL: " + err.Error())
+		return nil, options
+	}
+	body := webhookBody
+	if file, found := strings.CutPrefix(body, "@"); found {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			diag.Warn("Cannot read webhook body: " + err.Error())
+			return nil, options
+		}
+		body = string(content)
+	}
+	if s.body, err = template.New("body").Funcs(webhookFuncs).Parse(body); err != nil {
+		diag.Warn("Invalid webhook body: " + err.Error())
+		return nil, options
+	}
+	s.headers = make(map[string]*template.Template)
+	for _, header := range webhookHeaders {
+		name, value, found := strings.Cut(header, ":")
+		if !found {
+			diag.Warn("Invalid webhook header (name: value): " + header)
+			return nil, options
+		}
+		name = strings.TrimSpace(name)
+		if s.headers[name], err = template.New(name).Funcs(webhookFuncs).Parse(strings.TrimSpace(value)); err != nil {
+			diag.Warn("Invalid webhook header " + name + ": " + err.Error())
+			return nil, options
+		}
+	}
+	s.events = make(map[string]bool)
+	for _, event := range strings.Split(webhookEvents, ",") {
+		s.events[strings.TrimSpace(event)] = true
+	}
+
+	s.client = &http.Client{Timeout: time.Duration(webhookTimeout) * time.Second}
+	s.queue = make(chan *webhookRequest, webhookQueue)
+	s.abort = make(chan struct{})
+	s.done = make(chan struct{})
+	s.deadLetter = dataPath("webhook-dead.jsonl")
+	s.data = NewDatagram()
+	diag.Info("Posting " + webhookEvents + " events to webhook " + webhookURL)
+	return s, options
+}
+
+func (s *WebhookSink) Init() error {
+	go s.send()
+	return nil
+}
+
+func (s *WebhookSink) PublishDatagram(data *Datagram, forced bool) error {
+	s.data = data
+	if !s.events["datagram"] {
+		return nil
+	}
+	return s.post(&WebhookEvent{Event: "datagram", Datagram: data})
+}
+
+func (s *WebhookSink) PublishStatus(status *Status) error {
+	if !s.events["status"] {
+		return nil
+	}
+	return s.post(&WebhookEvent{Event: "status", Datagram: s.data, Status: status})
+}
+
+/*
+Send the waiting requests, for at most webhookDrain. The requests which
+are not sent by then are appended to the dead-letter file.
+*/
+func (s *WebhookSink) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.lock.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(webhookDrain):
+	}
+	diag.Warn("Webhook requests not sent in time; keeping them as dead letters.")
+	close(s.abort)
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(time.Duration(webhookTimeout) * time.Second):
+		return fmt.Errorf("webhook requests still being sent")
+	}
+}
+
+/* Render the templates for the event and queue the request. */
+func (s *WebhookSink) post(event *WebhookEvent) error {
+	event.Inverter = inverterName()
+	event.Site = site
+	event.Time = time.Now()
+
+	request := &webhookRequest{Time: event.Time, Event: event.Event, Headers: make(map[string]string)}
+	var out bytes.Buffer
+	if err := s.url.Execute(&out, event); err != nil {
+		return err
+	}
+	request.URL = strings.TrimSpace(out.String())
+	for name, header := range s.headers {
+		out.Reset()
+		if err := header.Execute(&out, event); err != nil {
+			return err
+		}
+		request.Headers[name] = out.String()
+	}
+	out.Reset()
+	if err := s.body.Execute(&out, event); err != nil {
+		return err
+	}
+	request.Body = out.String()
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return fmt.Errorf("webhook closed, %s event dropped", event.Event)
+	}
+	select {
+	case s.queue <- request:
+		s.lock.Unlock()
+		return nil
+	default:
+		s.lock.Unlock()
+		request.Error = "queue full"
+		s.dead(request)
+		return fmt.Errorf("webhook queue full, %s event dropped", event.Event)
+	}
+}
+
+/*
+Send the queued requests, with an increasing delay between retries. Once
+aborted, the remaining requests go to the dead-letter file.
+*/
+func (s *WebhookSink) send() {
+	defer close(s.done)
+	for request := range s.queue {
+		err := fmt.Errorf("not sent before termination")
+	attempts:
+		for attempt := 0; attempt <= webhookRetries; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-time.After(time.Duration(1<<(attempt-1)) * time.Second):
+				case <-s.abort:
+					break attempts
+				}
+			}
+			select {
+			case <-s.abort:
+				break attempts
+			default:
+			}
+			if err = s.deliver(request); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			diag.Warn("Webhook failed for " + request.Event + " event: " + err.Error())
+			request.Error = err.Error()
+			s.dead(request)
+		}
+	}
+}
+
+func (s *WebhookSink) deliver(request *webhookRequest) error {
+	method := "POST"
+	if request.Body == "" {
+		method = "GET"
+	}
+	httpRequest, err := http.NewRequest(method, request.URL, strings.NewReader(request.Body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	for name, value := range request.Headers {
+		httpRequest.Header.Set(name, value)
+	}
+	response, err := s.client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 256))
+		return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+/*
+Append the undelivered request to the dead-letter file. A file beyond
+webhookDeadMax is moved to .1 first, replacing the previous one.
+*/
+func (s *WebhookSink) dead(request *webhookRequest) {
+	if s.deadLetter == "" {
+		return
+	}
+	s.deadLock.Lock()
+	defer s.deadLock.Unlock()
+	if info, err := os.Stat(s.deadLetter); err == nil && info.Size() > webhookDeadMax {
+		if err := os.Rename(s.deadLetter, s.deadLetter+".1"); err != nil {
+			diag.Warn("Cannot rotate webhook dead letters: " + err.Error())
+		}
+	}
+	line, _ := json.Marshal(request)
+	file, err := os.OpenFile(s.deadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		diag.Warn("Cannot write webhook dead letter: " + err.Error())
+		return
+	}
+	defer file.Close()
+	_, _ = file.Write(append(line, '\n'))
+}